@@ -4,13 +4,19 @@ package proxmox
 
 import (
 	"crypto/tls"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
+	"net"
 	"net/http"
+	netUrl "net/url"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
@@ -20,12 +26,20 @@ const TaskTimeout = 90
 // TaskStatusCheckInterval - time between async checks in seconds
 const TaskStatusCheckInterval = 2
 
+// ShutdownTimeout - time for a graceful shutdown in StopVmForced in seconds
+const ShutdownTimeout = 120
+
+// RetryInterval - first delay before retrying a failed GET in seconds, doubled on each retry
+const RetryInterval = 2
+
 // Client - URL, user and password to specifc Proxmox node
 type Client struct {
 	session  *Session
 	ApiUrl   string
 	Username string
 	Password string
+	// Seconds WaitForCompletion waits for a task, TaskTimeout when 0, see WithTaskTimeout.
+	taskTimeout int
 }
 
 // VmRef - virtual machine ref parts
@@ -34,6 +48,9 @@ type VmRef struct {
 	vmId   int
 	node   string
 	vmType string
+	// GetVmConfig result, kept only when enabled with EnableConfigCache.
+	cacheConfig bool
+	configCache map[string]interface{}
 }
 
 func (vmr *VmRef) SetNode(node string) {
@@ -41,11 +58,41 @@ func (vmr *VmRef) SetNode(node string) {
 	return
 }
 
+// RefreshNode - look up the node the VM is on now, e.g. after a migration
+func (vmr *VmRef) RefreshNode(client *Client) error {
+	resources, err := client.GetClusterResources("vm")
+	if err != nil {
+		return err
+	}
+	for _, resource := range resources {
+		if resource.VmId == vmr.vmId {
+			vmr.node = resource.Node
+			vmr.vmType = resource.Type
+			vmr.InvalidateConfigCache()
+			return nil
+		}
+	}
+	return fmt.Errorf("vm %d not found in the cluster", vmr.vmId)
+}
+
 func (vmr *VmRef) SetVmType(vmType string) {
 	vmr.vmType = vmType
 	return
 }
 
+// EnableConfigCache - reuse the fetched config across GetVmConfig calls
+// until it is invalidated, either explicitly or by a config change made through the client.
+func (vmr *VmRef) EnableConfigCache() {
+	vmr.cacheConfig = true
+	return
+}
+
+// InvalidateConfigCache - the next GetVmConfig fetches the config again
+func (vmr *VmRef) InvalidateConfigCache() {
+	vmr.configCache = nil
+	return
+}
+
 func (vmr *VmRef) VmId() int {
 	return vmr.vmId
 }
@@ -54,6 +101,19 @@ func (vmr *VmRef) Node() string {
 	return vmr.node
 }
 
+// VmType - qemu or lxc, empty until the VmRef is checked with CheckVmRef or SetVmType
+func (vmr *VmRef) VmType() string {
+	return vmr.vmType
+}
+
+// Creating or changing a VM needs its node, it can't be looked up for a new VM.
+func (vmr *VmRef) checkNode() error {
+	if vmr.node == "" {
+		return fmt.Errorf("node not set on VmRef for vm %d, see VmRef.SetNode", vmr.vmId)
+	}
+	return nil
+}
+
 func NewVmRef(vmId int) (vmr *VmRef) {
 	vmr = &VmRef{vmId: vmId, node: "", vmType: ""}
 	return
@@ -74,21 +134,86 @@ func (c *Client) Login(username string, password string) (err error) {
 	return c.session.Login(username, password)
 }
 
+// WithTaskTimeout - a client sharing this one's session whose task waits
+// (clone, create, start, ...) give up after seconds instead of TaskTimeout.
+// For the odd long call, e.g. config.CloneVm(template, vmr, client.WithTaskTimeout(3600)),
+// while other calls keep the short default. The per-call timeout rides on the client instead of
+// being an argument of clone and the other long calls, so their signatures stay as they are.
+func (c *Client) WithTaskTimeout(seconds int) *Client {
+	longClient := *c
+	longClient.taskTimeout = seconds
+	return &longClient
+}
+
+// Logout - drop the session ticket and the stored credentials, see Session.Logout
+func (c *Client) Logout() {
+	c.session.Logout()
+	c.Username = ""
+	c.Password = ""
+}
+
+// GetJsonRetryable - GET retrying transient errors (network, 5xx) with a doubling delay.
+// Requests rejected by the API (4xx) are not retried.
 func (c *Client) GetJsonRetryable(url string, data *map[string]interface{}, tries int) error {
 	var statErr error
+	delay := RetryInterval * time.Second
 	for ii := 0; ii < tries; ii++ {
 		_, statErr = c.session.GetJSON(url, nil, nil, data)
 		if statErr == nil {
 			return nil
 		}
-		// if statErr != io.ErrUnexpectedEOF { // don't give up on ErrUnexpectedEOF
-		//   return statErr
-		// }
-		time.Sleep(5 * time.Second)
+		if apiErr, isAPIErr := statErr.(*ProxmoxAPIError); isAPIErr && apiErr.StatusCode < http.StatusInternalServerError {
+			return statErr
+		}
+		if isVmNotOnNodeErr(statErr) {
+			return statErr
+		}
+		if ii < tries-1 {
+			time.Sleep(delay)
+			delay = delay * 2
+		}
 	}
 	return statErr
 }
 
+var rxVmNotOnNode = regexp.MustCompile(`(qemu-server|lxc)/\d+\.conf' does not exist`)
+
+// Proxmox answers 500 "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist"
+// when asked for a VM on a node it isn't on (any more).
+// Other "does not exist" errors (a storage, a snapshot, ...) are no sign of a moved VM.
+func isVmNotOnNodeErr(err error) bool {
+	apiErr, isAPIErr := err.(*ProxmoxAPIError)
+	return isAPIErr && rxVmNotOnNode.MatchString(apiErr.Status)
+}
+
+// After a VM config not found error, point vmr at the VM's current node.
+// True when it moved, so the request is worth one more try.
+func (c *Client) followMovedVm(vmr *VmRef, err error) bool {
+	if !isVmNotOnNodeErr(err) {
+		return false
+	}
+	oldNode := vmr.node
+	if vmr.RefreshNode(c) != nil {
+		return false
+	}
+	return vmr.node != oldNode
+}
+
+// API path of the VM on the node vmr points at, e.g. /nodes/pve1/qemu/100
+func vmApiPath(vmr *VmRef) string {
+	return fmt.Sprintf("/nodes/%s/%s/%d", vmr.node, vmr.vmType, vmr.vmId)
+}
+
+// Run request with the VM's API path, once more on its new node when the VM was migrated
+// meanwhile. All requests for a VM go through here, so a VmRef keeps up with a moved VM.
+func (c *Client) onVmNode(vmr *VmRef, request func(vmPath string) error) (err error) {
+	err = request(vmApiPath(vmr))
+	if err != nil && c.followMovedVm(vmr, err) {
+		err = request(vmApiPath(vmr))
+	}
+	return
+}
+
 func (c *Client) GetNodeList() (list map[string]interface{}, err error) {
 	err = c.GetJsonRetryable("/nodes", &list, 3)
 	return
@@ -121,15 +246,110 @@ func (c *Client) GetVmInfo(vmr *VmRef) (vmInfo map[string]interface{}, err error
 	return nil, errors.New(fmt.Sprintf("Vm '%d' not found", vmr.vmId))
 }
 
+// ClusterResource - an entry of /cluster/resources, fields not used by its Type are left empty
+type ClusterResource struct {
+	ID       string
+	Type     string
+	VmId     int
+	Node     string
+	Storage  string
+	Name     string
+	Status   string
+	Template bool
+	Tags     string
+	MaxMem   int64
+	MaxDisk  int64
+}
+
+// GetClusterResources - resources of the whole cluster: "vm", "storage", "node", or "" for all
+func (c *Client) GetClusterResources(resType string) (resources []ClusterResource, err error) {
+	url := "/cluster/resources"
+	if resType != "" {
+		url += "?type=" + resType
+	}
+	var list map[string]interface{}
+	err = c.GetJsonRetryable(url, &list, 3)
+	if err != nil {
+		return nil, err
+	}
+	items, isList := list["data"].([]interface{})
+	if !isList {
+		return nil, errors.New("cluster resources not readable")
+	}
+	resources = make([]ClusterResource, 0, len(items))
+	for _, item := range items {
+		res, isMap := item.(map[string]interface{})
+		if !isMap {
+			continue
+		}
+		resource := ClusterResource{}
+		resource.ID, _ = res["id"].(string)
+		resource.Type, _ = res["type"].(string)
+		resource.Node, _ = res["node"].(string)
+		resource.Storage, _ = res["storage"].(string)
+		resource.Name, _ = res["name"].(string)
+		resource.Status, _ = res["status"].(string)
+		resource.Tags, _ = res["tags"].(string)
+		resource.VmId, _ = toInt(res["vmid"])
+		resource.Template = apiBool(res["template"])
+		if maxMem, isNumber := res["maxmem"].(float64); isNumber {
+			resource.MaxMem = int64(maxMem)
+		}
+		if maxDisk, isNumber := res["maxdisk"].(float64); isNumber {
+			resource.MaxDisk = int64(maxDisk)
+		}
+		resources = append(resources, resource)
+	}
+	return
+}
+
+// VmExists - is there a VM (qemu or lxc) with vmID in the cluster?
+func (c *Client) VmExists(vmID int) (exists bool, err error) {
+	resources, err := c.GetClusterResources("vm")
+	if err != nil {
+		return false, err
+	}
+	for _, resource := range resources {
+		if resource.VmId == vmID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ListQemuVmsByTag - qemu VMs of the cluster carrying tag, e.g. env-staging
+func (c *Client) ListQemuVmsByTag(tag string) (vms []ClusterResource, err error) {
+	resources, err := c.GetClusterResources("vm")
+	if err != nil {
+		return nil, err
+	}
+	vms = []ClusterResource{}
+	for _, resource := range resources {
+		if resource.Type == "qemu" && resource.HasTag(tag) {
+			vms = append(vms, resource)
+		}
+	}
+	return
+}
+
+// HasTag - is tag in Tags? Proxmox separates them with ;
+func (resource ClusterResource) HasTag(tag string) bool {
+	tags := strings.FieldsFunc(resource.Tags, func(r rune) bool {
+		return r == ';' || r == ',' || r == ' '
+	})
+	return inArray(tags, tag)
+}
+
 func (c *Client) GetVmRefByName(vmName string) (vmr *VmRef, err error) {
-	resp, err := c.GetVmList()
-	vms := resp["data"].([]interface{})
-	for vmii := range vms {
-		vm := vms[vmii].(map[string]interface{})
-		if vm["name"] != nil && vm["name"].(string) == vmName {
-			vmr = NewVmRef(int(vm["vmid"].(float64)))
-			vmr.node = vm["node"].(string)
-			vmr.vmType = vm["type"].(string)
+	vms, err := c.GetClusterResources("vm")
+	if err != nil {
+		return nil, err
+	}
+	for _, vm := range vms {
+		if vm.Name == vmName {
+			vmr = NewVmRef(vm.VmId)
+			vmr.node = vm.Node
+			vmr.vmType = vm.Type
 			return
 		}
 	}
@@ -142,8 +362,9 @@ func (c *Client) GetVmState(vmr *VmRef) (vmState map[string]interface{}, err err
 		return nil, err
 	}
 	var data map[string]interface{}
-	url := fmt.Sprintf("/nodes/%s/%s/%d/status/current", vmr.node, vmr.vmType, vmr.vmId)
-	err = c.GetJsonRetryable(url, &data, 3)
+	err = c.onVmNode(vmr, func(vmPath string) error {
+		return c.GetJsonRetryable(vmPath+"/status/current", &data, 3)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -154,14 +375,62 @@ func (c *Client) GetVmState(vmr *VmRef) (vmState map[string]interface{}, err err
 	return
 }
 
+// VmStatus - current state of a VM, memory in bytes.
+// The balloon fields are only filled while the balloon device is active,
+// FreeMem also needs the guest agent; HasBalloonStats tells whether they were reported.
+type VmStatus struct {
+	Status          string
+	QmpStatus       string
+	Uptime          int
+	Cpus            int
+	Cpu             float64
+	Mem             int
+	MaxMem          int
+	Balloon         int
+	BalloonMin      int
+	BalloonActual   int
+	FreeMem         int
+	HasBalloonStats bool
+}
+
+// GetVmStatus - GetVmState as a VmStatus
+func (c *Client) GetVmStatus(vmr *VmRef) (vmStatus VmStatus, err error) {
+	vmState, err := c.GetVmState(vmr)
+	if err != nil {
+		return vmStatus, err
+	}
+	vmStatus.Status, _ = vmState["status"].(string)
+	vmStatus.QmpStatus, _ = vmState["qmpstatus"].(string)
+	vmStatus.Cpu, _ = vmState["cpu"].(float64)
+	vmStatus.Uptime, _ = toInt(vmState["uptime"])
+	vmStatus.Cpus, _ = toInt(vmState["cpus"])
+	vmStatus.Mem, _ = toInt(vmState["mem"])
+	vmStatus.MaxMem, _ = toInt(vmState["maxmem"])
+	vmStatus.Balloon, _ = toInt(vmState["balloon"])
+	vmStatus.BalloonMin, _ = toInt(vmState["balloon_min"])
+	vmStatus.FreeMem, _ = toInt(vmState["freemem"])
+	if balloonInfo, isMap := vmState["ballooninfo"].(map[string]interface{}); isMap {
+		vmStatus.HasBalloonStats = true
+		vmStatus.BalloonActual, _ = toInt(balloonInfo["actual"])
+		if vmStatus.FreeMem == 0 {
+			vmStatus.FreeMem, _ = toInt(balloonInfo["free_mem"])
+		}
+	}
+	return
+}
+
 func (c *Client) GetVmConfig(vmr *VmRef) (vmConfig map[string]interface{}, err error) {
+	if vmr.cacheConfig && vmr.configCache != nil {
+		return copyVmConfig(vmr.configCache), nil
+	}
 	err = c.CheckVmRef(vmr)
 	if err != nil {
 		return nil, err
 	}
 	var data map[string]interface{}
-	url := fmt.Sprintf("/nodes/%s/%s/%d/config", vmr.node, vmr.vmType, vmr.vmId)
-	err = c.GetJsonRetryable(url, &data, 3)
+	err = c.onVmNode(vmr, func(vmPath string) error {
+		return c.GetJsonRetryable(vmPath+"/config", &data, 3)
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -169,6 +438,39 @@ func (c *Client) GetVmConfig(vmr *VmRef) (vmConfig map[string]interface{}, err e
 		return nil, errors.New("Vm CONFIG not readable")
 	}
 	vmConfig = data["data"].(map[string]interface{})
+	if vmr.cacheConfig {
+		vmr.configCache = copyVmConfig(vmConfig)
+	}
+	return
+}
+
+// The config values are strings and numbers, a shallow copy keeps callers off the cache.
+func copyVmConfig(vmConfig map[string]interface{}) map[string]interface{} {
+	configCopy := make(map[string]interface{}, len(vmConfig))
+	for key, value := range vmConfig {
+		configCopy[key] = value
+	}
+	return configCopy
+}
+
+// GetVmPendingConfig - config entries with the values staged for the next VM start
+// Each entry holds "key", the current "value" and, if changed, "pending" or "delete".
+func (c *Client) GetVmPendingConfig(vmr *VmRef) (vmPending []interface{}, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	err = c.onVmNode(vmr, func(vmPath string) error {
+		return c.GetJsonRetryable(vmPath+"/pending", &data, 3)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data["data"] == nil {
+		return nil, errors.New("Vm PENDING CONFIG not readable")
+	}
+	vmPending = data["data"].([]interface{})
 	return
 }
 
@@ -178,8 +480,14 @@ func (c *Client) MonitorCmd(vmr *VmRef, command string) (monitorRes map[string]i
 		return nil, err
 	}
 	reqbody := ParamsToBody(map[string]interface{}{"command": command})
-	url := fmt.Sprintf("/nodes/%s/%s/%d/monitor", vmr.node, vmr.vmType, vmr.vmId)
-	resp, err := c.session.Post(url, nil, nil, &reqbody)
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/monitor", nil, nil, &reqbody)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
 	monitorRes = ResponseJSON(resp)
 	return
 }
@@ -193,9 +501,13 @@ func (c *Client) WaitForCompletion(taskResponse map[string]interface{}) (waitExi
 	if taskResponse["data"] == nil {
 		return "", nil
 	}
+	timeout := c.taskTimeout
+	if timeout <= 0 {
+		timeout = TaskTimeout
+	}
 	waited := 0
 	taskUpid := taskResponse["data"].(string)
-	for waited < TaskTimeout {
+	for waited < timeout {
 		exitStatus, statErr := c.GetTaskExitstatus(taskUpid)
 		if statErr != nil {
 			if statErr != io.ErrUnexpectedEOF { // don't give up on ErrUnexpectedEOF
@@ -231,10 +543,15 @@ func (c *Client) StatusChangeVm(vmr *VmRef, setStatus string) (exitStatus string
 		return "", err
 	}
 
-	url := fmt.Sprintf("/nodes/%s/%s/%d/status/%s", vmr.node, vmr.vmType, vmr.vmId, setStatus)
 	var taskResponse map[string]interface{}
 	for i := 0; i < 3; i++ {
-		_, err = c.session.PostJSON(url, nil, nil, nil, &taskResponse)
+		err = c.onVmNode(vmr, func(vmPath string) (err error) {
+			_, err = c.session.PostJSON(vmPath+"/status/"+setStatus, nil, nil, nil, &taskResponse)
+			return
+		})
+		if err != nil {
+			return "", err
+		}
 		exitStatus, err = c.WaitForCompletion(taskResponse)
 		if exitStatus == "" {
 			time.Sleep(TaskStatusCheckInterval * time.Second)
@@ -257,14 +574,511 @@ func (c *Client) ShutdownVm(vmr *VmRef) (exitStatus string, err error) {
 	return c.StatusChangeVm(vmr, "shutdown")
 }
 
+// RebootVm - ACPI reboot of a running VM, the status/reboot action.
+// Not to be confused with ConfigQemu.Reboot, the config flag deciding what a guest-initiated reboot does.
+func (c *Client) RebootVm(vmr *VmRef) (exitStatus string, err error) {
+	return c.StatusChangeVm(vmr, "reboot")
+}
+
+// StartVmAndWait - start the VM and wait until Proxmox reports it running
+func (c *Client) StartVmAndWait(vmr *VmRef, timeout time.Duration) (exitStatus string, err error) {
+	exitStatus, err = c.StartVm(vmr)
+	if err != nil {
+		return
+	}
+	err = c.WaitForStatus(vmr, "running", timeout)
+	return
+}
+
+// StopVmForced - ShutdownVmWithTimeout with ShutdownTimeout
+func (c *Client) StopVmForced(vmr *VmRef) (forced bool, err error) {
+	return c.ShutdownVmWithTimeout(vmr, ShutdownTimeout*time.Second)
+}
+
+// ShutdownVmWithTimeout - ACPI shutdown, falling back to a hard stop when the guest
+// isn't off within graceful (e.g. no ACPI support or a hung guest).
+// forced reports whether the hard stop was used, other errors are returned without stopping the VM.
+func (c *Client) ShutdownVmWithTimeout(vmr *VmRef, graceful time.Duration) (forced bool, err error) {
+	_, forced, err = c.shutdownVm(vmr, graceful)
+	return
+}
+
+// ShutdownVmWithTimeout, with the exit status of the shutdown task or the stop task when forced.
+// Proxmox is told to give up the shutdown after graceful too: its task would otherwise run
+// until its own default timeout, which waiting on it would add to graceful.
+func (c *Client) shutdownVm(vmr *VmRef, graceful time.Duration) (exitStatus string, forced bool, err error) {
+	if err = c.CheckVmRef(vmr); err != nil {
+		return "", false, err
+	}
+	reqbody := ParamsToBody(map[string]interface{}{"timeout": int(math.Ceil(graceful.Seconds()))})
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/status/shutdown", nil, nil, &reqbody)
+		return
+	})
+	if err != nil {
+		return "", false, err
+	}
+	taskResponse := ResponseJSON(resp)
+	err = c.WaitForStatus(vmr, "stopped", graceful)
+	if err == nil {
+		// The VM is off, so the task is done.
+		exitStatus, err = c.WaitForCompletion(taskResponse)
+		return exitStatus, false, err
+	}
+	if _, isTimeout := err.(*statusTimeoutError); !isTimeout {
+		return "", false, err
+	}
+	exitStatus, err = c.StopVm(vmr)
+	return exitStatus, true, err
+}
+
+// VmPowerResult - outcome of StartAllVms/StopAllVms for one VM.
+// ExitStatus is the one of the start, shutdown or (when Forced) stop task.
+type VmPowerResult struct {
+	ExitStatus string
+	Forced     bool
+	Err        error
+}
+
+// StartAllVms - start the stopped qemu VMs on node in their startup order.
+// A VM failing (including reading its config) doesn't stop the others, see the Err of its result.
+func (c *Client) StartAllVms(node string) (results map[int]VmPowerResult, err error) {
+	vms, results, err := c.nodeVmsInStartupOrder(node, "stopped")
+	if err != nil {
+		return nil, err
+	}
+	for _, vmr := range vms {
+		result := VmPowerResult{}
+		result.ExitStatus, result.Err = c.StartVm(vmr)
+		results[vmr.vmId] = result
+	}
+	return
+}
+
+// StopAllVms - shut down the running qemu VMs on node in reverse startup order, e.g. before
+// rebooting the host. A VM still running after ShutdownTimeout is hard stopped (Forced).
+// A VM failing (including reading its config) doesn't stop the others, see the Err of its result.
+func (c *Client) StopAllVms(node string) (results map[int]VmPowerResult, err error) {
+	vms, results, err := c.nodeVmsInStartupOrder(node, "running")
+	if err != nil {
+		return nil, err
+	}
+	for ii := len(vms) - 1; ii >= 0; ii-- {
+		result := VmPowerResult{}
+		result.ExitStatus, result.Forced, result.Err = c.shutdownVm(vms[ii], ShutdownTimeout*time.Second)
+		results[vms[ii].vmId] = result
+	}
+	return
+}
+
+// VMs without a startup order go after the ordered ones, like Proxmox does on boot.
+// The VMs whose config can't be read are left out, with the error in failed.
+func (c *Client) nodeVmsInStartupOrder(node string, status string) (vms []*VmRef, failed map[int]VmPowerResult, err error) {
+	resources, err := c.GetClusterResources("vm")
+	if err != nil {
+		return nil, nil, err
+	}
+	failed = map[int]VmPowerResult{}
+	order := map[int]int{}
+	for _, resource := range resources {
+		if resource.Type != "qemu" || resource.Node != node || resource.Template || resource.Status != status {
+			continue
+		}
+		vmr := NewVmRef(resource.VmId)
+		vmr.SetNode(node)
+		vmr.SetVmType("qemu")
+		vmConfig, err := c.GetVmConfig(vmr)
+		if err != nil {
+			failed[vmr.vmId] = VmPowerResult{Err: err}
+			continue
+		}
+		order[vmr.vmId] = math.MaxInt32
+		startup, _ := vmConfig["startup"].(string)
+		for _, option := range strings.Split(startup, ",") {
+			if strings.HasPrefix(option, "order=") {
+				if startupOrder, err := strconv.Atoi(strings.TrimPrefix(option, "order=")); err == nil {
+					order[vmr.vmId] = startupOrder
+				}
+			}
+		}
+		vms = append(vms, vmr)
+	}
+	sort.SliceStable(vms, func(i, j int) bool {
+		if order[vms[i].vmId] != order[vms[j].vmId] {
+			return order[vms[i].vmId] < order[vms[j].vmId]
+		}
+		return vms[i].vmId < vms[j].vmId
+	})
+	return
+}
+
+// SampleVmUsage - average cpu (fraction of the VM's cpus) and memory in bytes over samples
+// taken interval apart. Samples while the VM isn't running are left out, an error when none was.
+func (c *Client) SampleVmUsage(vmr *VmRef, samples int, interval time.Duration) (avgCpu float64, avgMem int, err error) {
+	running := 0
+	totalMem := 0
+	for ii := 0; ii < samples; ii++ {
+		if ii > 0 {
+			time.Sleep(interval)
+		}
+		vmStatus, err := c.GetVmStatus(vmr)
+		if err != nil {
+			return 0, 0, err
+		}
+		if vmStatus.Status != "running" {
+			continue
+		}
+		running++
+		avgCpu += vmStatus.Cpu
+		totalMem += vmStatus.Mem
+	}
+	if running == 0 {
+		return 0, 0, fmt.Errorf("vm %d not running during sampling", vmr.vmId)
+	}
+	return avgCpu / float64(running), totalMem / running, nil
+}
+
+// WaitForGuestAgent - wait until the QEMU guest agent in the VM answers a ping,
+// a better sign the guest OS is up than the VM running. Needs ConfigQemu.Agent enabled
+// and the agent installed in the guest, otherwise it only times out.
+func (c *Client) WaitForGuestAgent(vmr *VmRef, timeout time.Duration) (err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		err = c.onVmNode(vmr, func(vmPath string) (err error) {
+			_, err = c.session.Post(vmPath+"/agent/ping", nil, nil, nil)
+			return
+		})
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("guest agent of vm %d not responding within %v: %v", vmr.vmId, timeout, err)
+		}
+		time.Sleep(TaskStatusCheckInterval * time.Second)
+	}
+}
+
+// AgentInterface - guest network interface as reported by the QEMU guest agent
+type AgentInterface struct {
+	Name        string
+	MacAddress  string
+	IPAddresses []net.IP
+}
+
+// GetAgentInterfaces - network interfaces of the guest, loopback left out.
+// The usual way to learn the address a VM got by DHCP, needs a running guest agent.
+func (c *Client) GetAgentInterfaces(vmr *VmRef) (interfaces []AgentInterface, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return nil, err
+	}
+	var data struct {
+		Data struct {
+			Result []struct {
+				Name            string `json:"name"`
+				HardwareAddress string `json:"hardware-address"`
+				IPAddresses     []struct {
+					IPAddress string `json:"ip-address"`
+				} `json:"ip-addresses"`
+			} `json:"result"`
+		} `json:"data"`
+	}
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.GetJSON(vmPath+"/agent/network-get-interfaces", nil, nil, &data)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	interfaces = []AgentInterface{}
+	for _, iface := range data.Data.Result {
+		if iface.Name == "lo" {
+			continue
+		}
+		agentInterface := AgentInterface{
+			Name:        iface.Name,
+			MacAddress:  iface.HardwareAddress,
+			IPAddresses: []net.IP{},
+		}
+		for _, addr := range iface.IPAddresses {
+			if ip := net.ParseIP(addr.IPAddress); ip != nil && !ip.IsLoopback() {
+				agentInterface.IPAddresses = append(agentInterface.IPAddresses, ip)
+			}
+		}
+		interfaces = append(interfaces, agentInterface)
+	}
+	return
+}
+
+// AgentExecResult - state of a command started with AgentExec
+// Proxmox already decodes the base64 output the guest agent returns.
+type AgentExecResult struct {
+	Exited       bool
+	ExitCode     int
+	OutData      string
+	ErrData      string
+	OutTruncated bool
+	ErrTruncated bool
+}
+
+// AgentExec - start a command in the guest through the guest agent, without waiting for it.
+// command is the program followed by its arguments, use AgentExecStatus with the pid for the result.
+func (c *Client) AgentExec(vmr *VmRef, command []string) (pid int, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return 0, err
+	}
+	if len(command) == 0 {
+		return 0, errors.New("agent exec needs a command")
+	}
+	reqbody := ParamsToBody(map[string]interface{}{"command": command})
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/agent/exec", nil, nil, &reqbody)
+		return
+	})
+	if err != nil {
+		return 0, err
+	}
+	execRes := ResponseJSON(resp)
+	data, isMap := execRes["data"].(map[string]interface{})
+	if !isMap {
+		return 0, errors.New("agent exec response not readable")
+	}
+	return toInt(data["pid"])
+}
+
+// AgentExecStatus - output and exit code of a command started with AgentExec
+func (c *Client) AgentExecStatus(vmr *VmRef, pid int) (result AgentExecResult, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return result, err
+	}
+	var data map[string]interface{}
+	params := netUrl.Values{"pid": []string{strconv.Itoa(pid)}}
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.GetJSON(vmPath+"/agent/exec-status", &params, nil, &data)
+		return
+	})
+	if err != nil {
+		return result, err
+	}
+	status, isMap := data["data"].(map[string]interface{})
+	if !isMap {
+		return result, errors.New("agent exec status not readable")
+	}
+	result.Exited = apiBool(status["exited"])
+	result.ExitCode, _ = toInt(status["exitcode"])
+	result.OutData, _ = status["out-data"].(string)
+	result.ErrData, _ = status["err-data"].(string)
+	result.OutTruncated = apiBool(status["out-truncated"])
+	result.ErrTruncated = apiBool(status["err-truncated"])
+	return
+}
+
+// AgentFileWriteMaxSize - the largest base64 content Proxmox accepts for agent/file-write
+const AgentFileWriteMaxSize = 61440
+
+// AgentFileWrite - write content to path in the guest through the guest agent, replacing the file.
+func (c *Client) AgentFileWrite(vmr *VmRef, path string, content []byte) (err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return err
+	}
+	encoded := base64.StdEncoding.EncodeToString(content)
+	if len(encoded) > AgentFileWriteMaxSize {
+		return fmt.Errorf("agent file-write content for %s is %d bytes base64 encoded, the limit is %d",
+			path, len(encoded), AgentFileWriteMaxSize)
+	}
+	// encode=0 as the content is already base64, binary content would not survive the form encoding.
+	reqbody := ParamsToBody(map[string]interface{}{
+		"file":    path,
+		"content": encoded,
+		"encode":  false,
+	})
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.Post(vmPath+"/agent/file-write", nil, nil, &reqbody)
+		return
+	})
+	return
+}
+
+// AgentFileRead - content of path in the guest, read through the guest agent.
+// Proxmox stops reading at 16 MiB, a longer file returns an error instead of partial content.
+func (c *Client) AgentFileRead(vmr *VmRef, path string) (content []byte, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return nil, err
+	}
+	var data map[string]interface{}
+	params := netUrl.Values{"file": []string{path}}
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.GetJSON(vmPath+"/agent/file-read", &params, nil, &data)
+		return
+	})
+	if err != nil {
+		return nil, err
+	}
+	file, isMap := data["data"].(map[string]interface{})
+	if !isMap {
+		return nil, errors.New("agent file-read response not readable")
+	}
+	if apiBool(file["truncated"]) {
+		return nil, fmt.Errorf("agent file-read of %s truncated, the file exceeds the Proxmox read limit", path)
+	}
+	text, _ := file["content"].(string)
+	return []byte(text), nil
+}
+
+// SetVmConsolePassword - protect the SPICE console of the running VM with password,
+// set through the QEMU monitor. It only lasts until the VM stops: Proxmox has no persistent
+// console password, clients normally use the one-time tickets of GetSpiceProxy/GetVncProxy.
+func (c *Client) SetVmConsolePassword(vmr *VmRef, password string) (err error) {
+	if len(password) < 8 || strings.ContainsAny(password, " \t\n") {
+		return errors.New("console password needs at least 8 characters and no whitespace")
+	}
+	monitorRes, err := c.MonitorCmd(vmr, "set_password spice "+password)
+	if err != nil {
+		return err
+	}
+	// The monitor answers errors as text, success is silent.
+	if output, _ := monitorRes["data"].(string); strings.TrimSpace(output) != "" {
+		return fmt.Errorf("set console password on vm %d: %s", vmr.vmId, strings.TrimSpace(output))
+	}
+	return nil
+}
+
+// VncProxy - ticket for a VNC console, valid for a short time.
+// Connect through the node's vncwebsocket with Port and Ticket, authenticating as User.
+type VncProxy struct {
+	Ticket string
+	Port   int
+	User   string
+	Cert   string
+	Upid   string
+}
+
+// GetVncProxy - open a VNC console proxy for the VM
+func (c *Client) GetVncProxy(vmr *VmRef) (vncProxy VncProxy, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return vncProxy, err
+	}
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/vncproxy", nil, nil, nil)
+		return
+	})
+	if err != nil {
+		return vncProxy, err
+	}
+	data, isMap := ResponseJSON(resp)["data"].(map[string]interface{})
+	if !isMap {
+		return vncProxy, errors.New("vncproxy response not readable")
+	}
+	// Proxmox returns the port as a string.
+	if vncProxy.Port, err = toInt(data["port"]); err != nil {
+		return vncProxy, fmt.Errorf("vncproxy port: %v", err)
+	}
+	vncProxy.Ticket, _ = data["ticket"].(string)
+	vncProxy.User, _ = data["user"].(string)
+	vncProxy.Cert, _ = data["cert"].(string)
+	vncProxy.Upid, _ = data["upid"].(string)
+	return
+}
+
+// SpiceProxy - connection settings for a SPICE console, the fields of a remote-viewer .vv file.
+// Password is a one-time ticket, valid for a short time.
+type SpiceProxy struct {
+	Type        string
+	Host        string
+	Proxy       string
+	TlsPort     int
+	Password    string
+	HostSubject string
+	CA          string
+	Title       string
+}
+
+// GetSpiceProxy - open a SPICE console proxy for the VM, needs a SPICE display (vga=qxl)
+func (c *Client) GetSpiceProxy(vmr *VmRef) (spiceProxy SpiceProxy, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return spiceProxy, err
+	}
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/spiceproxy", nil, nil, nil)
+		return
+	})
+	if err != nil {
+		return spiceProxy, err
+	}
+	data, isMap := ResponseJSON(resp)["data"].(map[string]interface{})
+	if !isMap {
+		return spiceProxy, errors.New("spiceproxy response not readable")
+	}
+	if spiceProxy.TlsPort, err = toInt(data["tls-port"]); err != nil {
+		return spiceProxy, fmt.Errorf("spiceproxy tls-port: %v", err)
+	}
+	spiceProxy.Type, _ = data["type"].(string)
+	spiceProxy.Host, _ = data["host"].(string)
+	spiceProxy.Proxy, _ = data["proxy"].(string)
+	spiceProxy.Password, _ = data["password"].(string)
+	spiceProxy.HostSubject, _ = data["host-subject"].(string)
+	spiceProxy.CA, _ = data["ca"].(string)
+	spiceProxy.Title, _ = data["title"].(string)
+	return
+}
+
+// WaitForStatus gave up, as opposed to a request failing.
+type statusTimeoutError struct {
+	msg string
+}
+
+func (e *statusTimeoutError) Error() string {
+	return e.msg
+}
+
+// WaitForStatus - poll the VM until its status is target (running, stopped, paused, ...).
+// Errors reading the status are retried until the timeout.
+func (c *Client) WaitForStatus(vmr *VmRef, target string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	lastStatus := "unknown"
+	for {
+		vmState, err := c.GetVmState(vmr)
+		if err == nil {
+			lastStatus = fmt.Sprintf("%v", vmState["status"])
+			if lastStatus == target {
+				return nil
+			}
+		}
+		if time.Now().After(deadline) {
+			return &statusTimeoutError{fmt.Sprintf("vm %d not %s within %v, last status: %s", vmr.vmId, target, timeout, lastStatus)}
+		}
+		time.Sleep(TaskStatusCheckInterval * time.Second)
+	}
+}
+
 func (c *Client) DeleteVm(vmr *VmRef) (exitStatus string, err error) {
 	err = c.CheckVmRef(vmr)
 	if err != nil {
 		return "", err
 	}
-	url := fmt.Sprintf("/nodes/%s/%s/%d", vmr.node, vmr.vmType, vmr.vmId)
+	vmr.InvalidateConfigCache()
 	var taskResponse map[string]interface{}
-	_, err = c.session.RequestJSON("DELETE", url, nil, nil, nil, &taskResponse)
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.RequestJSON("DELETE", vmPath, nil, nil, nil, &taskResponse)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
 	exitStatus, err = c.WaitForCompletion(taskResponse)
 	return
 }
@@ -280,10 +1094,84 @@ func (c *Client) CreateQemuVm(node string, vmParams map[string]interface{}) (exi
 	return
 }
 
+// ImportOvf - create a VM from an OVF/OVA appliance, e.g. exported from VMware.
+// manifestPath is the volume on an import storage (local:import/appliance.ova), disks are
+// imported to storage. Name, cores, memory, disks and nics come from the manifest,
+// nics without a bridge are put on vmbr0. Needs Proxmox 8.2 or later.
+func (c *Client) ImportOvf(node string, manifestPath string, storage string) (vmr *VmRef, err error) {
+	importStorage := strings.SplitN(manifestPath, ":", 2)[0]
+	if importStorage == manifestPath {
+		return nil, fmt.Errorf("invalid manifest '%s', expected a volume like local:import/appliance.ova", manifestPath)
+	}
+	var data map[string]interface{}
+	url := fmt.Sprintf("/nodes/%s/storage/%s/import-metadata", node, importStorage)
+	params := netUrl.Values{"volume": []string{manifestPath}}
+	_, err = c.session.GetJSON(url, &params, nil, &data)
+	if err != nil {
+		return nil, err
+	}
+	metadata, isMap := data["data"].(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("import metadata of %s not readable", manifestPath)
+	}
+
+	vmID, err := c.GetNextID(0)
+	if err != nil {
+		return nil, err
+	}
+	vmParams := map[string]interface{}{"vmid": vmID}
+	if createArgs, isMap := metadata["create-args"].(map[string]interface{}); isMap {
+		for key, value := range createArgs {
+			vmParams[key] = value
+		}
+	}
+	if disks, isMap := metadata["disks"].(map[string]interface{}); isMap {
+		for disk, volume := range disks {
+			vmParams[disk] = fmt.Sprintf("%s:0,import-from=%v", storage, volume)
+		}
+	}
+	if nets, isMap := metadata["net"].(map[string]interface{}); isMap {
+		for nic, nicConf := range nets {
+			vmParams[nic] = importNicParam(nicConf)
+		}
+	}
+	_, err = c.CreateQemuVm(node, vmParams)
+	if err != nil {
+		return nil, err
+	}
+	vmr = NewVmRef(vmID)
+	vmr.SetNode(node)
+	vmr.SetVmType("qemu")
+	return
+}
+
+// netN param from an import-metadata nic, given either as a string or as options.
+func importNicParam(nicConf interface{}) string {
+	options, isMap := nicConf.(map[string]interface{})
+	if !isMap {
+		return fmt.Sprintf("%v", nicConf)
+	}
+	model, _ := options["model"].(string)
+	if model == "" {
+		model = "e1000"
+	}
+	nicParam := QemuDeviceParam{"model=" + model}
+	if _, isSet := options["bridge"]; !isSet {
+		nicParam = append(nicParam, "bridge=vmbr0")
+	}
+	nicParam = nicParam.createDeviceParam(options, []string{"model"})
+	return strings.Join(nicParam, ",")
+}
+
 func (c *Client) CloneQemuVm(vmr *VmRef, vmParams map[string]interface{}) (exitStatus string, err error) {
 	reqbody := ParamsToBody(vmParams)
-	url := fmt.Sprintf("/nodes/%s/qemu/%d/clone", vmr.node, vmr.vmId)
-	resp, err := c.session.Post(url, nil, nil, &reqbody)
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(string) (err error) {
+		// Only QEMU VMs clone here, whatever type vmr was given.
+		url := fmt.Sprintf("/nodes/%s/qemu/%d/clone", vmr.node, vmr.vmId)
+		resp, err = c.session.Post(url, nil, nil, &reqbody)
+		return
+	})
 	if err == nil {
 		taskResponse := ResponseJSON(resp)
 		exitStatus, err = c.WaitForCompletion(taskResponse)
@@ -291,23 +1179,130 @@ func (c *Client) CloneQemuVm(vmr *VmRef, vmParams map[string]interface{}) (exitS
 	return
 }
 
+// CreateQemuSnapshot - snapshot the VM, with vmstate including its RAM so a rollback resumes it running.
+// The RAM goes to stateStorage, or to the vmstatestorage already set on the VM when empty.
+// Proxmox only takes the state storage from the VM config: a different stateStorage is set as
+// vmstatestorage for the snapshot and the previous value is put back afterwards.
+func (c *Client) CreateQemuSnapshot(vmr *VmRef, snapshot string, description string, vmstate bool, stateStorage string) (exitStatus string, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return "", err
+	}
+	if vmstate {
+		var vmConfig map[string]interface{}
+		vmConfig, err = c.GetVmConfig(vmr)
+		if err != nil {
+			return "", err
+		}
+		currentStorage, _ := vmConfig["vmstatestorage"].(string)
+		if stateStorage == "" && currentStorage == "" {
+			return "", fmt.Errorf("snapshot with vmstate of vm %d needs a state storage, vmstatestorage isn't set", vmr.vmId)
+		}
+		if stateStorage != "" && stateStorage != currentStorage {
+			if _, err = c.SetVmConfig(vmr, map[string]interface{}{"vmstatestorage": stateStorage}); err != nil {
+				return "", err
+			}
+			restoreParams := map[string]interface{}{"vmstatestorage": currentStorage}
+			if currentStorage == "" {
+				restoreParams = map[string]interface{}{"delete": "vmstatestorage"}
+			}
+			defer func() {
+				if _, restoreErr := c.SetVmConfig(vmr, restoreParams); restoreErr != nil && err == nil {
+					err = restoreErr
+				}
+			}()
+		}
+	}
+	vmr.InvalidateConfigCache()
+	reqbody := ParamsToBody(map[string]interface{}{
+		"snapname":    snapshot,
+		"description": description,
+		"vmstate":     vmstate,
+	})
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/snapshot", nil, nil, &reqbody)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
+	taskResponse := ResponseJSON(resp)
+	exitStatus, err = c.WaitForCompletion(taskResponse)
+	return
+}
+
 func (c *Client) RollbackQemuVm(vmr *VmRef, snapshot string) (exitStatus string, err error) {
 	err = c.CheckVmRef(vmr)
 	if err != nil {
 		return "", err
 	}
-	url := fmt.Sprintf("/nodes/%s/%s/%d/snapshot/%s/rollback", vmr.node, vmr.vmType, vmr.vmId, snapshot)
+	vmr.InvalidateConfigCache()
 	var taskResponse map[string]interface{}
-	_, err = c.session.PostJSON(url, nil, nil, nil, &taskResponse)
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		_, err = c.session.PostJSON(vmPath+"/snapshot/"+snapshot+"/rollback", nil, nil, nil, &taskResponse)
+		return
+	})
+	if err != nil {
+		return "", err
+	}
 	exitStatus, err = c.WaitForCompletion(taskResponse)
 	return
 }
 
+// CreateQemuSnapshotAndWait - CreateQemuSnapshot waiting up to timeout instead of TaskTimeout,
+// as saving the RAM of a vmstate snapshot can take a while. A failed task is returned as error.
+func (c *Client) CreateQemuSnapshotAndWait(vmr *VmRef, snapshot string, description string, vmstate bool, stateStorage string, timeout time.Duration) (exitStatus string, err error) {
+	seconds, err := taskTimeoutSeconds(timeout)
+	if err != nil {
+		return "", err
+	}
+	exitStatus, err = c.WithTaskTimeout(seconds).CreateQemuSnapshot(vmr, snapshot, description, vmstate, stateStorage)
+	if err == nil {
+		err = taskExitError(exitStatus)
+	}
+	return
+}
+
+// RollbackQemuSnapshotAndWait - RollbackQemuVm waiting up to timeout instead of TaskTimeout.
+// A failed task is returned as error.
+func (c *Client) RollbackQemuSnapshotAndWait(vmr *VmRef, snapshot string, timeout time.Duration) (exitStatus string, err error) {
+	seconds, err := taskTimeoutSeconds(timeout)
+	if err != nil {
+		return "", err
+	}
+	exitStatus, err = c.WithTaskTimeout(seconds).RollbackQemuVm(vmr, snapshot)
+	if err == nil {
+		err = taskExitError(exitStatus)
+	}
+	return
+}
+
+// timeout in whole seconds for WithTaskTimeout, rounded up: 0 would mean TaskTimeout.
+func taskTimeoutSeconds(timeout time.Duration) (int, error) {
+	if timeout <= 0 {
+		return 0, fmt.Errorf("invalid task timeout %v, expected more than 0", timeout)
+	}
+	return int(math.Ceil(timeout.Seconds())), nil
+}
+
+// Tasks end with OK, WARNINGS: N or the error message.
+func taskExitError(exitStatus string) error {
+	if exitStatus == "" || exitStatus == "OK" || strings.HasPrefix(exitStatus, "WARNINGS") {
+		return nil
+	}
+	return fmt.Errorf("task failed: %s", exitStatus)
+}
+
 // SetVmConfig - send config options
 func (c *Client) SetVmConfig(vmr *VmRef, vmParams map[string]interface{}) (exitStatus interface{}, err error) {
+	vmr.InvalidateConfigCache()
 	reqbody := ParamsToBody(vmParams)
-	url := fmt.Sprintf("/nodes/%s/%s/%d/config", vmr.node, vmr.vmType, vmr.vmId)
-	resp, err := c.session.Post(url, nil, nil, &reqbody)
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/config", nil, nil, &reqbody)
+		return
+	})
 	if err == nil {
 		taskResponse := ResponseJSON(resp)
 		exitStatus, err = c.WaitForCompletion(taskResponse)
@@ -315,6 +1310,25 @@ func (c *Client) SetVmConfig(vmr *VmRef, vmParams map[string]interface{}) (exitS
 	return
 }
 
+// RenameVm - change only the name of the VM
+func (c *Client) RenameVm(vmr *VmRef, newName string) (exitStatus interface{}, err error) {
+	if err = validateVmName(newName); err != nil {
+		return nil, err
+	}
+	if err = c.CheckVmRef(vmr); err != nil {
+		return nil, err
+	}
+	return c.SetVmConfig(vmr, map[string]interface{}{"name": newName})
+}
+
+// SetVmDescription - change only the description of the VM, leaving the rest of the config alone
+func (c *Client) SetVmDescription(vmr *VmRef, desc string) (exitStatus interface{}, err error) {
+	if err = c.CheckVmRef(vmr); err != nil {
+		return nil, err
+	}
+	return c.SetVmConfig(vmr, map[string]interface{}{"description": desc})
+}
+
 func (c *Client) ResizeQemuDisk(vmr *VmRef, disk string, moreSizeGB int) (exitStatus interface{}, err error) {
 	// PUT
 	//disk:virtio0
@@ -322,10 +1336,77 @@ func (c *Client) ResizeQemuDisk(vmr *VmRef, disk string, moreSizeGB int) (exitSt
 	if disk == "" {
 		disk = "virtio0"
 	}
+	if _, err = c.getQemuDiskConfig(vmr, disk); err != nil {
+		return nil, err
+	}
+	vmr.InvalidateConfigCache()
 	size := fmt.Sprintf("+%dG", moreSizeGB)
 	reqbody := ParamsToBody(map[string]interface{}{"disk": disk, "size": size})
-	url := fmt.Sprintf("/nodes/%s/%s/%d/resize", vmr.node, vmr.vmType, vmr.vmId)
-	resp, err := c.session.Put(url, nil, nil, &reqbody)
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Put(vmPath+"/resize", nil, nil, &reqbody)
+		return
+	})
+	if err == nil {
+		taskResponse := ResponseJSON(resp)
+		exitStatus, err = c.WaitForCompletion(taskResponse)
+	}
+	return
+}
+
+// Resize disk to at least newSizeGB, nothing to do when it's already that big.
+// Disks can't shrink, ResizeQemuDisk only adds whole GBs.
+func (c *Client) growQemuDisk(vmr *VmRef, disk string, newSizeGB int) (err error) {
+	diskConf, err := c.getQemuDiskConfig(vmr, disk)
+	if err != nil {
+		return err
+	}
+	device := QemuDevice{}
+	device.readDeviceConfig(strings.Split(diskConf, ",")[1:])
+	size, err := normalizeDiskSize(device["size"])
+	if err != nil {
+		return fmt.Errorf("%s: %v", disk, err)
+	}
+	currentGB, _ := diskSizeGB(size)
+	moreSizeGB := int(math.Ceil(float64(newSizeGB) - currentGB))
+	if moreSizeGB <= 0 {
+		return nil
+	}
+	_, err = c.ResizeQemuDisk(vmr, disk, moreSizeGB)
+	return
+}
+
+// MoveQemuDisk - move disk (e.g. scsi0) to storage, converting it to format unless empty.
+// With deleteSource the old volume is removed, otherwise it stays as an unusedN disk.
+func (c *Client) MoveQemuDisk(vmr *VmRef, disk string, storage string, format string, deleteSource bool) (exitStatus interface{}, err error) {
+	if _, err = c.getQemuDiskConfig(vmr, disk); err != nil {
+		return nil, err
+	}
+	if format != "" {
+		// Not every storage can hold every format, e.g. qcow2 on lvmthin.
+		storageType, err := c.GetStorageType(vmr.node, storage)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = diskFormat(storageType, format); err != nil {
+			return nil, fmt.Errorf("can't move %s to %s: %v", disk, storage, err)
+		}
+	}
+	vmr.InvalidateConfigCache()
+	params := map[string]interface{}{
+		"disk":    disk,
+		"storage": storage,
+		"delete":  deleteSource,
+	}
+	if format != "" {
+		params["format"] = format
+	}
+	reqbody := ParamsToBody(params)
+	var resp *http.Response
+	err = c.onVmNode(vmr, func(vmPath string) (err error) {
+		resp, err = c.session.Post(vmPath+"/move_disk", nil, nil, &reqbody)
+		return
+	})
 	if err == nil {
 		taskResponse := ResponseJSON(resp)
 		exitStatus, err = c.WaitForCompletion(taskResponse)
@@ -333,6 +1414,216 @@ func (c *Client) ResizeQemuDisk(vmr *VmRef, disk string, moreSizeGB int) (exitSt
 	return
 }
 
+// AddNetworkInterface - add nic (see NewNic) to the VM on the first free netN, returning
+// that index and the MAC, generated when nic has none. A running VM only gets the nic
+// right away with network in its Hotplug (the default), otherwise on the next start.
+func (c *Client) AddNetworkInterface(vmr *VmRef, nic QemuDevice) (nicID int, macaddr string, err error) {
+	vmr.InvalidateConfigCache()
+	vmConfig, err := c.GetVmConfig(vmr)
+	if err != nil {
+		return -1, "", err
+	}
+	nicID = NextFreeNetIndex(vmConfig)
+	ostype, _ := vmConfig["ostype"].(string)
+	nicConfig := ConfigQemu{QemuOs: ostype, QemuNetworks: QemuDevices{nicID: nic.copy()}}
+	if err = nicConfig.Validate(); err != nil {
+		return -1, "", err
+	}
+	params := map[string]interface{}{}
+	if err = nicConfig.CreateQemuNetworksParams(vmr.vmId, params); err != nil {
+		return -1, "", err
+	}
+	if _, err = c.SetVmConfig(vmr, params); err != nil {
+		return -1, "", err
+	}
+	macaddr, _ = nicConfig.QemuNetworks[nicID]["macaddr"].(string)
+	return
+}
+
+// DetachQemuDisk - unlink a disk from the VM, it stays on the storage as an unusedN volume.
+// With destroy the unused volume is removed as well, deleting the disk data.
+func (c *Client) DetachQemuDisk(vmr *VmRef, disk string, destroy bool) (exitStatus interface{}, err error) {
+	diskConf, err := c.getQemuDiskConfig(vmr, disk)
+	if err != nil {
+		return nil, err
+	}
+	volume := strings.Split(diskConf, ",")[0]
+
+	exitStatus, err = c.SetVmConfig(vmr, map[string]interface{}{"delete": disk})
+	if err != nil || !destroy {
+		return
+	}
+
+	// The detached volume shows up again as unusedN, deleting that destroys it.
+	vmConfig, err := c.GetVmConfig(vmr)
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range vmConfig {
+		if strings.HasPrefix(key, "unused") && value == volume {
+			return c.SetVmConfig(vmr, map[string]interface{}{"delete": key})
+		}
+	}
+	return nil, fmt.Errorf("detached volume '%s' not found as unused disk on vm %d", volume, vmr.vmId)
+}
+
+// Config string of disk (e.g. scsi0) on the VM, the error lists the disks it does have.
+func (c *Client) getQemuDiskConfig(vmr *VmRef, disk string) (diskConf string, err error) {
+	vmConfig, err := c.GetVmConfig(vmr)
+	if err != nil {
+		return "", err
+	}
+	disks := []string{}
+	for key, value := range vmConfig {
+		conf, _ := value.(string)
+		if !rxDiskName.MatchString(key) || strings.Contains(conf, "media=cdrom") {
+			continue
+		}
+		if key == disk {
+			return conf, nil
+		}
+		disks = append(disks, key)
+	}
+	sort.Strings(disks)
+	return "", fmt.Errorf("disk '%s' not found on vm %d, it has: %s", disk, vmr.vmId, strings.Join(disks, ", "))
+}
+
+// MigrationStatus - progress of the latest migration of a VM, sizes in bytes.
+// Transferred and Total are 0 until the RAM transfer of a live migration starts.
+type MigrationStatus struct {
+	Upid        string
+	Running     bool
+	ExitStatus  string
+	Transferred int64
+	Remaining   int64
+	Total       int64
+}
+
+var (
+	// PVE 6+: migration active, transferred 512.3 MiB of 4.0 GiB VM-state, 101.1 MiB/s
+	rxMigrationProgress = regexp.MustCompile(`migration active, transferred ([\d.]+ [KMGT]?i?B) of ([\d.]+ [KMGT]?i?B)`)
+	// Older: migration status: active (transferred 545335578, remaining 3741528064), total 4312137728)
+	rxMigrationProgressBytes = regexp.MustCompile(`migration status: active \(transferred (\d+), remaining (\d+)\), total (\d+)\)`)
+	migrationSizeUnits       = map[string]float64{"B": 1, "KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30, "TiB": 1 << 40}
+)
+
+// GetMigrationStatus - state of the latest qmigrate task of the VM on its (source) node,
+// with the progress from the task log.
+func (c *Client) GetMigrationStatus(vmr *VmRef) (status MigrationStatus, err error) {
+	err = c.CheckVmRef(vmr)
+	if err != nil {
+		return status, err
+	}
+	var data map[string]interface{}
+	url := fmt.Sprintf("/nodes/%s/tasks", vmr.node)
+	params := netUrl.Values{
+		"vmid":       []string{strconv.Itoa(vmr.vmId)},
+		"typefilter": []string{"qmigrate"},
+		"limit":      []string{"1"},
+	}
+	_, err = c.session.GetJSON(url, &params, nil, &data)
+	if err != nil {
+		return status, err
+	}
+	tasks, _ := data["data"].([]interface{})
+	if len(tasks) == 0 {
+		return status, fmt.Errorf("no migration found for vm %d on node %s", vmr.vmId, vmr.node)
+	}
+	task, _ := tasks[0].(map[string]interface{})
+	status.Upid, _ = task["upid"].(string)
+
+	exitStatus, err := c.GetTaskExitstatus(status.Upid)
+	if err != nil {
+		return status, err
+	}
+	status.ExitStatus, _ = exitStatus.(string)
+	status.Running = exitStatus == nil
+
+	url = fmt.Sprintf("/nodes/%s/tasks/%s/log", vmr.node, status.Upid)
+	params = netUrl.Values{"limit": []string{"100000"}}
+	_, err = c.session.GetJSON(url, &params, nil, &data)
+	if err != nil {
+		return status, err
+	}
+	lines, _ := data["data"].([]interface{})
+	for _, line := range lines {
+		entry, _ := line.(map[string]interface{})
+		text, _ := entry["t"].(string)
+		if progress := rxMigrationProgress.FindStringSubmatch(text); progress != nil {
+			status.Transferred = migrationSize(progress[1])
+			status.Total = migrationSize(progress[2])
+			status.Remaining = status.Total - status.Transferred
+		} else if progress := rxMigrationProgressBytes.FindStringSubmatch(text); progress != nil {
+			status.Transferred, _ = strconv.ParseInt(progress[1], 10, 64)
+			status.Remaining, _ = strconv.ParseInt(progress[2], 10, 64)
+			status.Total, _ = strconv.ParseInt(progress[3], 10, 64)
+		}
+	}
+	return
+}
+
+// Bytes of a task log size like 512.3 MiB.
+func migrationSize(size string) int64 {
+	valueAndUnit := strings.Fields(size)
+	value, _ := strconv.ParseFloat(valueAndUnit[0], 64)
+	return int64(value * migrationSizeUnits[valueAndUnit[1]])
+}
+
+// HotplugCpu - set the active vcpus of a running VM, up to sockets*cores.
+// Needs cpu in the VM's Hotplug, the error says so when the change would only apply after a restart.
+func (c *Client) HotplugCpu(vmr *VmRef, vcpus int) (err error) {
+	return c.hotplugConfig(vmr, "cpu", "vcpus", vcpus)
+}
+
+// HotplugMemory - set the memory of a running VM in MB, see AlignHotplugMemory.
+// Needs memory in the VM's Hotplug (and numa), the error says so when the change would only apply after a restart.
+func (c *Client) HotplugMemory(vmr *VmRef, mb int) (err error) {
+	if mb != AlignHotplugMemory(mb) {
+		return fmt.Errorf("memory %d can't be hotplugged, expected at least 1024 and a multiple of 512 like %d",
+			mb, AlignHotplugMemory(mb))
+	}
+	return c.hotplugConfig(vmr, "memory", "memory", mb)
+}
+
+// Set key on the running VM when device is hotpluggable, and check Proxmox applied it
+// instead of keeping it pending.
+func (c *Client) hotplugConfig(vmr *VmRef, device string, key string, value int) (err error) {
+	vmr.InvalidateConfigCache()
+	vmConfig, err := c.GetVmConfig(vmr)
+	if err != nil {
+		return err
+	}
+	// Proxmox default, also meant by 1.
+	hotplug := "network,disk,usb"
+	if value, isSet := vmConfig["hotplug"]; isSet && fmt.Sprintf("%v", value) != "1" {
+		hotplug = fmt.Sprintf("%v", value)
+	}
+	if !(ConfigQemu{Hotplug: hotplug}).hotplugs(device) {
+		return fmt.Errorf("%s hotplug not enabled on vm %d (hotplug: %s)", device, vmr.vmId, hotplug)
+	}
+	_, err = c.SetVmConfig(vmr, map[string]interface{}{key: value})
+	if err != nil {
+		return err
+	}
+	vmPending, err := c.GetVmPendingConfig(vmr)
+	if err != nil {
+		return err
+	}
+	for _, entry := range vmPending {
+		item, _ := entry.(map[string]interface{})
+		if item["key"] == key && item["pending"] != nil {
+			return fmt.Errorf("%s %d not applied to running vm %d, pending until restart", key, value, vmr.vmId)
+		}
+	}
+	return nil
+}
+
+// ClusterNextId - free VMID suggested by the cluster (/cluster/nextid)
+// Prefer it over MaxVmId+1, which races with concurrent provisioners.
+func (c *Client) ClusterNextId() (nextID int, err error) {
+	return c.GetNextID(0)
+}
+
 // GetNextID - Get next free VMID
 func (c *Client) GetNextID(currentID int) (nextID int, err error) {
 	var data map[string]interface{}
@@ -343,15 +1634,112 @@ func (c *Client) GetNextID(currentID int) (nextID int, err error) {
 		url = "/cluster/nextid"
 	}
 	_, err = c.session.GetJSON(url, nil, nil, &data)
-	if err == nil {
-		if data["errors"] != nil {
-			if currentID != 0 {
-				return c.GetNextID(0)
-			} else {
-				return -1, errors.New("error using /cluster/nextid")
-			}
+	if _, isAPIErr := err.(*ProxmoxAPIError); isAPIErr {
+		// The requested vmid is taken, fall back to the first free one.
+		if currentID != 0 {
+			return c.GetNextID(0)
 		}
+		return -1, err
+	}
+	if err == nil {
 		nextID, err = strconv.Atoi(data["data"].(string))
 	}
 	return
 }
+
+func (c *Client) getStorageStatus(node string, storage string) (status map[string]interface{}, err error) {
+	var data map[string]interface{}
+	url := fmt.Sprintf("/nodes/%s/storage/%s/status", node, storage)
+	_, err = c.session.GetJSON(url, nil, nil, &data)
+	if err != nil {
+		return nil, err
+	}
+	status, isMap := data["data"].(map[string]interface{})
+	if !isMap {
+		return nil, fmt.Errorf("storage %s status not readable", storage)
+	}
+	return
+}
+
+// GetStorageContent - content types a storage on node is enabled for, e.g. images, iso, snippets
+func (c *Client) GetStorageContent(node string, storage string) (content []string, err error) {
+	status, err := c.getStorageStatus(node, storage)
+	if err != nil {
+		return nil, err
+	}
+	contentList, _ := status["content"].(string)
+	return strings.Split(contentList, ","), nil
+}
+
+// GetStorageType - Proxmox type of a storage on node, e.g. dir, lvmthin, zfspool, rbd
+func (c *Client) GetStorageType(node string, storage string) (storageType string, err error) {
+	status, err := c.getStorageStatus(node, storage)
+	if err != nil {
+		return "", err
+	}
+	storageType, _ = status["type"].(string)
+	if storageType == "" {
+		return "", fmt.Errorf("storage %s on node %s has no type", storage, node)
+	}
+	return
+}
+
+// HA states a VM can be managed with, started and stopped are the usual ones.
+var haStates = []string{"started", "stopped", "enabled", "disabled", "ignored"}
+
+// VmHaState - HA resource of a VM
+type VmHaState struct {
+	Sid   string
+	State string
+	Group string
+}
+
+// GetVmHaState - HA settings of the VM, an error when it isn't HA managed
+func (c *Client) GetVmHaState(vmr *VmRef) (haState VmHaState, err error) {
+	var data map[string]interface{}
+	url := fmt.Sprintf("/cluster/ha/resources/vm:%d", vmr.vmId)
+	_, err = c.session.GetJSON(url, nil, nil, &data)
+	if err != nil {
+		return haState, err
+	}
+	resource, isMap := data["data"].(map[string]interface{})
+	if !isMap {
+		return haState, fmt.Errorf("ha resource of vm %d not readable", vmr.vmId)
+	}
+	haState.Sid, _ = resource["sid"].(string)
+	haState.State, _ = resource["state"].(string)
+	haState.Group, _ = resource["group"].(string)
+	return
+}
+
+// Proxmox answers 500 "no such resource 'vm:100'" for a VM that isn't HA managed.
+func isNoHaResourceErr(err error) bool {
+	apiErr, isAPIErr := err.(*ProxmoxAPIError)
+	return isAPIErr && strings.Contains(apiErr.Status, "no such resource")
+}
+
+// SetVmHaState - put the VM under HA management with the state HA keeps it in
+// (started, stopped, ignored, ...), or change it when already managed. group is optional.
+func (c *Client) SetVmHaState(vmr *VmRef, group string, state string) (err error) {
+	if !inArray(haStates, state) {
+		return fmt.Errorf("invalid ha state '%s', expected one of: %s", state, strings.Join(haStates, ", "))
+	}
+	params := map[string]interface{}{"state": state}
+	if group != "" {
+		params["group"] = group
+	}
+	sid := fmt.Sprintf("vm:%d", vmr.vmId)
+	_, err = c.GetVmHaState(vmr)
+	if isNoHaResourceErr(err) {
+		params["sid"] = sid
+		reqbody := ParamsToBody(params)
+		_, err = c.session.Post("/cluster/ha/resources", nil, nil, &reqbody)
+		return
+	}
+	if err != nil {
+		return
+	}
+	reqbody := ParamsToBody(params)
+	_, err = c.session.Put("/cluster/ha/resources/"+sid, nil, nil, &reqbody)
+	return
+}
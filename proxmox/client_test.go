@@ -0,0 +1,1487 @@
+package proxmox
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Answer of a fake route, data is sent as {"data": data}.
+// A status of 400 or more fails the request with message as reason, like Proxmox does.
+type fakeResponse struct {
+	status  int
+	message string
+	data    interface{}
+}
+
+type fakeCall struct {
+	route string
+	form  url.Values
+}
+
+// fakeProxmox - a Proxmox API stand-in for the client's http.Client, answering
+// "METHOD /path" routes and recording the calls made.
+type fakeProxmox struct {
+	mu     sync.Mutex
+	routes map[string]func(form url.Values) fakeResponse
+	calls  []fakeCall
+}
+
+func newFakeClient(t *testing.T) (*Client, *fakeProxmox) {
+	fake := &fakeProxmox{routes: map[string]func(form url.Values) fakeResponse{}}
+	client, err := NewClient("https://pve.test:8006/api2/json", &http.Client{Transport: fake}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client, fake
+}
+
+func (f *fakeProxmox) RoundTrip(req *http.Request) (*http.Response, error) {
+	form := req.URL.Query()
+	if req.Body != nil {
+		body, _ := ioutil.ReadAll(req.Body)
+		bodyForm, _ := url.ParseQuery(string(body))
+		for key, values := range bodyForm {
+			form[key] = append(form[key], values...)
+		}
+	}
+	route := req.Method + " " + strings.TrimPrefix(req.URL.Path, "/api2/json")
+	f.mu.Lock()
+	f.calls = append(f.calls, fakeCall{route: route, form: form})
+	handler, isSet := f.routes[route]
+	f.mu.Unlock()
+
+	answer := fakeResponse{status: http.StatusNotImplemented, message: "no fake route " + route}
+	if isSet {
+		answer = handler(form)
+	}
+	if answer.status == 0 {
+		answer.status = http.StatusOK
+	}
+	body, _ := json.Marshal(map[string]interface{}{"data": answer.data})
+	return &http.Response{
+		StatusCode: answer.status,
+		Status:     fmt.Sprintf("%d %s", answer.status, answer.message),
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       ioutil.NopCloser(bytes.NewReader(body)),
+		Request:    req,
+	}, nil
+}
+
+func (f *fakeProxmox) handle(route string, handler func(form url.Values) fakeResponse) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.routes[route] = handler
+}
+
+// Route always answering data.
+func (f *fakeProxmox) answer(route string, data interface{}) {
+	f.handle(route, func(url.Values) fakeResponse { return fakeResponse{data: data} })
+}
+
+// Task UPID on node whose status route reports exitStatus, to answer a task starting route with.
+func (f *fakeProxmox) task(node string, name string, exitStatus string) string {
+	upid := fmt.Sprintf("UPID:%s:0000A1B2:00C3D4E5:6543210F:%s:100:root@pam:", node, name)
+	f.answer("GET /nodes/"+node+"/tasks/"+upid+"/status", map[string]interface{}{"status": "stopped", "exitstatus": exitStatus})
+	return upid
+}
+
+// Route starting a task that ends with OK.
+func (f *fakeProxmox) okTask(route string, node string) {
+	f.answer(route, f.task(node, "qmtask", "OK"))
+}
+
+// The /cluster/resources list, e.g. fakeVm(100, "pve1", "running").
+func (f *fakeProxmox) resources(resources ...map[string]interface{}) {
+	f.answer("GET /cluster/resources", resources)
+}
+
+func fakeVm(vmID int, node string, status string) map[string]interface{} {
+	return map[string]interface{}{
+		"id": fmt.Sprintf("qemu/%d", vmID), "type": "qemu", "vmid": float64(vmID),
+		"node": node, "status": status, "name": fmt.Sprintf("vm%d", vmID),
+	}
+}
+
+// Calls made to route, in order.
+func (f *fakeProxmox) callsTo(route string) (calls []fakeCall) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, call := range f.calls {
+		if call.route == route {
+			calls = append(calls, call)
+		}
+	}
+	return
+}
+
+func (f *fakeProxmox) routesCalled() (routes []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, call := range f.calls {
+		routes = append(routes, call.route)
+	}
+	return
+}
+
+func qemuVmRef(vmID int, node string) *VmRef {
+	vmr := NewVmRef(vmID)
+	vmr.SetNode(node)
+	vmr.SetVmType("qemu")
+	return vmr
+}
+
+func TestSetVmConsolePassword(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("POST /nodes/pve1/qemu/100/monitor", "")
+	if err := client.SetVmConsolePassword(qemuVmRef(100, "pve1"), "correct horse"); err == nil {
+		t.Errorf("password with whitespace accepted")
+	}
+	if err := client.SetVmConsolePassword(qemuVmRef(100, "pve1"), "Tr0ub4dor"); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.callsTo("POST /nodes/pve1/qemu/100/monitor")
+	if len(calls) != 1 || calls[0].form.Get("command") != "set_password spice Tr0ub4dor" {
+		t.Errorf("monitor calls = %v, want one set_password spice Tr0ub4dor", calls)
+	}
+
+	fake.answer("POST /nodes/pve1/qemu/100/monitor", "Could not set password")
+	if err := client.SetVmConsolePassword(qemuVmRef(100, "pve1"), "Tr0ub4dor"); err == nil {
+		t.Errorf("monitor error output not returned")
+	}
+}
+
+func TestGetVmConfigCache(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", diffVmConfig)
+	fake.answer("GET /nodes/pve1/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images"})
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/pending", []interface{}{})
+	vmr := qemuVmRef(100, "pve1")
+	vmr.EnableConfigCache()
+	current, err := NewConfigQemuFromApi(vmr, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current.Memory = 4096
+	if err = current.UpdateConfig(vmr, client); err != nil {
+		t.Fatal(err)
+	}
+	if reads := fake.callsTo("GET /nodes/pve1/qemu/100/config"); len(reads) != 1 {
+		t.Errorf("%d config reads across read+update, want 1", len(reads))
+	}
+
+	// Changing a returned config leaves the cache alone.
+	vmConfig, err := client.GetVmConfig(vmr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vmConfig["memory"] = float64(8192)
+	if vmConfig, _ = client.GetVmConfig(vmr); vmConfig["memory"] != float64(2048) {
+		t.Errorf("memory = %v, want the cached 2048", vmConfig["memory"])
+	}
+	if reads := fake.callsTo("GET /nodes/pve1/qemu/100/config"); len(reads) != 2 {
+		t.Errorf("%d config reads, want 2 with one after the update", len(reads))
+	}
+}
+
+func TestShutdownVmWithTimeoutIgnoredAcpi(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/shutdown", "pve1")
+	fake.okTask("POST /nodes/pve1/qemu/100/status/stop", "pve1")
+	// The guest ignores the ACPI shutdown.
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "running"})
+	forced, err := client.ShutdownVmWithTimeout(qemuVmRef(100, "pve1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forced || len(fake.callsTo("POST /nodes/pve1/qemu/100/status/stop")) != 1 {
+		t.Errorf("forced = %v, calls = %v, want a hard stop", forced, fake.routesCalled())
+	}
+}
+
+func TestShutdownVmWithTimeoutHungTask(t *testing.T) {
+	client, fake := newFakeClient(t)
+	// The shutdown task never finishes and the guest stays up.
+	upid := "UPID:pve1:0000A1B2:00C3D4E5:6543210F:qmshutdown:100:root@pam:"
+	fake.answer("POST /nodes/pve1/qemu/100/status/shutdown", upid)
+	fake.answer("GET /nodes/pve1/tasks/"+upid+"/status", map[string]interface{}{"status": "running"})
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "running"})
+	fake.okTask("POST /nodes/pve1/qemu/100/status/stop", "pve1")
+	forced, err := client.ShutdownVmWithTimeout(qemuVmRef(100, "pve1"), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !forced || len(fake.callsTo("POST /nodes/pve1/qemu/100/status/stop")) != 1 {
+		t.Errorf("forced = %v, calls = %v, want a hard stop", forced, fake.routesCalled())
+	}
+	shutdowns := fake.callsTo("POST /nodes/pve1/qemu/100/status/shutdown")
+	if len(shutdowns) != 1 || shutdowns[0].form.Get("timeout") != "0" {
+		t.Errorf("shutdowns = %v, want one with timeout=0", shutdowns)
+	}
+	if calls := fake.callsTo("GET /nodes/pve1/tasks/" + upid + "/status"); len(calls) != 0 {
+		t.Errorf("waited on the shutdown task")
+	}
+}
+
+func TestShutdownVmWithTimeoutClean(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/shutdown", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "stopped"})
+	forced, err := client.ShutdownVmWithTimeout(qemuVmRef(100, "pve1"), 1500*time.Millisecond)
+	if err != nil || forced {
+		t.Errorf("forced = %v, err = %v, want a clean shutdown", forced, err)
+	}
+	// Proxmox gives up after the same time, in whole seconds.
+	if shutdowns := fake.callsTo("POST /nodes/pve1/qemu/100/status/shutdown"); len(shutdowns) != 1 || shutdowns[0].form.Get("timeout") != "2" {
+		t.Errorf("shutdowns = %v, want timeout=2", shutdowns)
+	}
+}
+
+func TestShutdownVmWithTimeoutError(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.handle("POST /nodes/pve1/qemu/100/status/shutdown", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusForbidden, message: "Permission check failed (/vms/100, VM.PowerMgmt)"}
+	})
+	forced, err := client.ShutdownVmWithTimeout(qemuVmRef(100, "pve1"), time.Minute)
+	if err == nil || forced {
+		t.Errorf("forced = %v, err = %v, want the permission error", forced, err)
+	}
+	if calls := fake.callsTo("POST /nodes/pve1/qemu/100/status/stop"); len(calls) != 0 {
+		t.Errorf("VM hard stopped after a failed shutdown request")
+	}
+}
+
+func fakeNodeVms(fake *fakeProxmox, status string) {
+	template := fakeVm(900, "pve1", "stopped")
+	template["template"] = float64(1)
+	fake.resources(fakeVm(101, "pve1", status), fakeVm(102, "pve1", status), fakeVm(103, "pve1", status),
+		fakeVm(104, "pve1", status), fakeVm(200, "pve2", status), template)
+	fake.answer("GET /nodes/pve1/qemu/101/config", map[string]interface{}{"startup": "order=2"})
+	fake.answer("GET /nodes/pve1/qemu/102/config", map[string]interface{}{})
+	fake.answer("GET /nodes/pve1/qemu/103/config", map[string]interface{}{"startup": "order=1,up=30"})
+	fake.handle("GET /nodes/pve1/qemu/104/config", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusForbidden, message: "Permission check failed"}
+	})
+}
+
+func TestStartAllVms(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeNodeVms(fake, "stopped")
+	fake.okTask("POST /nodes/pve1/qemu/101/status/start", "pve1")
+	fake.okTask("POST /nodes/pve1/qemu/103/status/start", "pve1")
+	fake.handle("POST /nodes/pve1/qemu/102/status/start", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusInternalServerError, message: "start failed: out of memory"}
+	})
+	results, err := client.StartAllVms("pve1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	starts := []string{}
+	for _, route := range fake.routesCalled() {
+		if strings.HasSuffix(route, "/status/start") {
+			starts = append(starts, route)
+		}
+	}
+	want := []string{
+		"POST /nodes/pve1/qemu/103/status/start",
+		"POST /nodes/pve1/qemu/101/status/start",
+		"POST /nodes/pve1/qemu/102/status/start",
+	}
+	if strings.Join(starts, "\n") != strings.Join(want, "\n") {
+		t.Errorf("starts = %v, want %v", starts, want)
+	}
+	if len(results) != 4 {
+		t.Errorf("results = %v, want 101-104", results)
+	}
+	for _, vmID := range []int{101, 103} {
+		if results[vmID].Err != nil || results[vmID].ExitStatus != "OK" {
+			t.Errorf("vm %d: %+v, want started", vmID, results[vmID])
+		}
+	}
+	for _, vmID := range []int{102, 104} {
+		if results[vmID].Err == nil {
+			t.Errorf("vm %d: %+v, want its error", vmID, results[vmID])
+		}
+	}
+}
+
+func TestStopAllVms(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeNodeVms(fake, "running")
+	for _, vmID := range []int{101, 102, 103} {
+		fake.okTask(fmt.Sprintf("POST /nodes/pve1/qemu/%d/status/shutdown", vmID), "pve1")
+		fake.answer(fmt.Sprintf("GET /nodes/pve1/qemu/%d/status/current", vmID), map[string]interface{}{"status": "stopped"})
+	}
+	results, err := client.StopAllVms("pve1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	shutdowns := []string{}
+	for _, route := range fake.routesCalled() {
+		if strings.HasSuffix(route, "/status/stop") {
+			t.Errorf("%s, want only shutdowns", route)
+		}
+		if strings.HasSuffix(route, "/status/shutdown") {
+			shutdowns = append(shutdowns, route)
+		}
+	}
+	want := []string{
+		"POST /nodes/pve1/qemu/102/status/shutdown",
+		"POST /nodes/pve1/qemu/101/status/shutdown",
+		"POST /nodes/pve1/qemu/103/status/shutdown",
+	}
+	if strings.Join(shutdowns, "\n") != strings.Join(want, "\n") {
+		t.Errorf("shutdowns = %v, want %v", shutdowns, want)
+	}
+	for _, vmID := range []int{101, 102, 103} {
+		if results[vmID].Err != nil || results[vmID].ExitStatus != "OK" || results[vmID].Forced {
+			t.Errorf("vm %d: %+v, want shut down", vmID, results[vmID])
+		}
+	}
+	if results[104].Err == nil {
+		t.Errorf("vm 104: %+v, want the config error", results[104])
+	}
+}
+
+func TestCreateQemuSnapshotStateStorage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{"vmstatestorage": "local-lvm"})
+	fake.answer("POST /nodes/pve1/qemu/100/config", nil)
+	fake.okTask("POST /nodes/pve1/qemu/100/snapshot", "pve1")
+	exitStatus, err := client.CreateQemuSnapshot(qemuVmRef(100, "pve1"), "before-upgrade", "", true, "ceph-state")
+	if err != nil || exitStatus != "OK" {
+		t.Fatalf("exitStatus = %q, err = %v", exitStatus, err)
+	}
+	configs := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(configs) != 2 || configs[0].form.Get("vmstatestorage") != "ceph-state" || configs[1].form.Get("vmstatestorage") != "local-lvm" {
+		t.Errorf("config calls = %v, want vmstatestorage set to ceph-state and back to local-lvm", configs)
+	}
+	snapshots := fake.callsTo("POST /nodes/pve1/qemu/100/snapshot")
+	if len(snapshots) != 1 || snapshots[0].form.Get("vmstate") != "1" || snapshots[0].form.Get("snapname") != "before-upgrade" {
+		t.Errorf("snapshot calls = %v, want vmstate=1 snapname=before-upgrade", snapshots)
+	}
+}
+
+func TestCreateQemuSnapshotNoStateStorage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{})
+	if _, err := client.CreateQemuSnapshot(qemuVmRef(100, "pve1"), "s1", "", true, ""); err == nil {
+		t.Errorf("vmstate snapshot without a state storage accepted")
+	}
+	if calls := fake.callsTo("POST /nodes/pve1/qemu/100/snapshot"); len(calls) != 0 {
+		t.Errorf("snapshot requested without a state storage")
+	}
+}
+
+func TestCreateQemuSnapshotRestoresUnsetStateStorage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{})
+	fake.answer("POST /nodes/pve1/qemu/100/config", nil)
+	fake.okTask("POST /nodes/pve1/qemu/100/snapshot", "pve1")
+	if _, err := client.CreateQemuSnapshot(qemuVmRef(100, "pve1"), "s1", "", true, "local-lvm"); err != nil {
+		t.Fatal(err)
+	}
+	configs := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(configs) != 2 || configs[1].form.Get("delete") != "vmstatestorage" {
+		t.Errorf("config calls = %v, want vmstatestorage deleted again", configs)
+	}
+}
+
+func TestSetVmHaState(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.handle("GET /cluster/ha/resources/vm:100", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusInternalServerError, message: "no such resource 'vm:100'"}
+	})
+	fake.answer("POST /cluster/ha/resources", nil)
+	if err := client.SetVmHaState(qemuVmRef(100, "pve1"), "prod", "started"); err != nil {
+		t.Fatal(err)
+	}
+	posts := fake.callsTo("POST /cluster/ha/resources")
+	if len(posts) != 1 || posts[0].form.Get("sid") != "vm:100" || posts[0].form.Get("state") != "started" || posts[0].form.Get("group") != "prod" {
+		t.Errorf("posts = %v, want sid=vm:100 state=started group=prod", posts)
+	}
+
+	fake.answer("GET /cluster/ha/resources/vm:100", map[string]interface{}{"sid": "vm:100", "state": "started"})
+	fake.answer("PUT /cluster/ha/resources/vm:100", nil)
+	if err := client.SetVmHaState(qemuVmRef(100, "pve1"), "", "stopped"); err != nil {
+		t.Fatal(err)
+	}
+	puts := fake.callsTo("PUT /cluster/ha/resources/vm:100")
+	if len(puts) != 1 || puts[0].form.Get("state") != "stopped" || puts[0].form.Get("sid") != "" {
+		t.Errorf("puts = %v, want state=stopped", puts)
+	}
+
+	if err := client.SetVmHaState(qemuVmRef(100, "pve1"), "", "running"); err == nil {
+		t.Errorf("invalid state accepted")
+	}
+}
+
+func TestSetVmHaStateError(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.handle("GET /cluster/ha/resources/vm:100", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusForbidden, message: "Permission check failed (/, Sys.Console)"}
+	})
+	if err := client.SetVmHaState(qemuVmRef(100, "pve1"), "", "started"); err == nil {
+		t.Errorf("permission error not returned")
+	}
+	if posts := fake.callsTo("POST /cluster/ha/resources"); len(posts) != 0 {
+		t.Errorf("HA resource created after a permission error")
+	}
+}
+
+// The VM was migrated from pve1 to pve2 since vmr was made.
+func fakeMovedVm(fake *fakeProxmox) {
+	fake.resources(fakeVm(100, "pve2", "running"))
+	for _, route := range []string{"GET /nodes/pve1/qemu/100/config", "POST /nodes/pve1/qemu/100/config", "POST /nodes/pve1/qemu/100/monitor"} {
+		fake.handle(route, func(url.Values) fakeResponse {
+			return fakeResponse{status: http.StatusInternalServerError, message: "Configuration file 'nodes/pve1/qemu-server/100.conf' does not exist"}
+		})
+	}
+}
+
+func TestMovedVmRetried(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeMovedVm(fake)
+	fake.okTask("POST /nodes/pve2/qemu/100/config", "pve2")
+	fake.answer("POST /nodes/pve2/qemu/100/monitor", "")
+	vmr := qemuVmRef(100, "pve1")
+	if _, err := client.SetVmConfig(vmr, map[string]interface{}{"memory": 2048}); err != nil {
+		t.Fatal(err)
+	}
+	if vmr.Node() != "pve2" {
+		t.Errorf("vmr node = %s, want pve2", vmr.Node())
+	}
+	if calls := fake.callsTo("POST /nodes/pve2/qemu/100/config"); len(calls) != 1 || calls[0].form.Get("memory") != "2048" {
+		t.Errorf("config calls on pve2 = %v, want memory=2048", calls)
+	}
+
+	vmr = qemuVmRef(100, "pve1")
+	if _, err := client.MonitorCmd(vmr, "info status"); err != nil {
+		t.Fatal(err)
+	}
+	if len(fake.callsTo("POST /nodes/pve2/qemu/100/monitor")) != 1 {
+		t.Errorf("calls = %v, want the monitor command retried on pve2", fake.routesCalled())
+	}
+}
+
+func TestMovedVmOtherNotExistError(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.resources(fakeVm(100, "pve2", "running"))
+	fake.handle("POST /nodes/pve1/qemu/100/move_disk", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusInternalServerError, message: "storage 'ceph' does not exist"}
+	})
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=8G"})
+	vmr := qemuVmRef(100, "pve1")
+	if _, err := client.MoveQemuDisk(vmr, "scsi0", "ceph", "", true); err == nil {
+		t.Errorf("storage error not returned")
+	}
+	if vmr.Node() != "pve1" || len(fake.callsTo("GET /cluster/resources")) != 0 {
+		t.Errorf("node = %s, calls = %v, want no moved VM lookup", vmr.Node(), fake.routesCalled())
+	}
+}
+
+func TestEnsureVmCreateWrongStorage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.resources(fakeVm(101, "pve1", "running"))
+	fake.answer("GET /nodes/pve1/storage/local/status", map[string]interface{}{"type": "dir", "content": "iso,vztmpl"})
+	config := ConfigQemu{Name: "web1", QemuDisks: QemuDevices{0: {"type": "scsi", "storage": "local", "size": "8G"}}}
+	if _, err := config.EnsureVm(qemuVmRef(100, "pve1"), client); err == nil || !strings.Contains(err.Error(), "doesn't hold images") {
+		t.Errorf("err = %v, want the storage content error", err)
+	}
+	if creates := fake.callsTo("POST /nodes/pve1/qemu"); len(creates) != 0 {
+		t.Errorf("VM created on a storage without images")
+	}
+}
+
+func TestHotplugMemoryDisabled(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{"memory": float64(2048)})
+	err := client.HotplugMemory(qemuVmRef(100, "pve1"), 4096)
+	if err == nil || !strings.Contains(err.Error(), "memory hotplug not enabled") {
+		t.Errorf("err = %v, want memory hotplug not enabled", err)
+	}
+	if len(fake.callsTo("POST /nodes/pve1/qemu/100/config")) != 0 {
+		t.Errorf("memory set without memory hotplug")
+	}
+	if err = client.HotplugMemory(qemuVmRef(100, "pve1"), 3000); err == nil {
+		t.Errorf("unaligned memory accepted")
+	}
+}
+
+func TestHotplugCpuPending(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{"hotplug": "network,disk,cpu", "vcpus": float64(2)})
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/pending", []interface{}{
+		map[string]interface{}{"key": "vcpus", "value": float64(2), "pending": float64(4)},
+	})
+	if err := client.HotplugCpu(qemuVmRef(100, "pve1"), 4); err == nil || !strings.Contains(err.Error(), "pending until restart") {
+		t.Errorf("err = %v, want vcpus pending until restart", err)
+	}
+
+	fake.answer("GET /nodes/pve1/qemu/100/pending", []interface{}{
+		map[string]interface{}{"key": "vcpus", "value": float64(4)},
+	})
+	if err := client.HotplugCpu(qemuVmRef(100, "pve1"), 4); err != nil {
+		t.Fatal(err)
+	}
+	if updates := fake.callsTo("POST /nodes/pve1/qemu/100/config"); len(updates) != 2 || updates[1].form.Get("vcpus") != "4" {
+		t.Errorf("updates = %v, want vcpus=4", updates)
+	}
+}
+
+func TestEnsureVmCreate(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.resources(fakeVm(101, "pve1", "running"))
+	fake.answer("GET /nodes/pve1/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images,rootdir"})
+	fake.okTask("POST /nodes/pve1/qemu", "pve1")
+	vmr := qemuVmRef(100, "pve1")
+	config := ConfigQemu{Name: "web1", Memory: 2048, QemuDisks: QemuDevices{0: {"type": "scsi", "storage": "local-lvm", "size": "8G"}}}
+	created, err := config.EnsureVm(vmr, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creates := fake.callsTo("POST /nodes/pve1/qemu")
+	if !created || len(creates) != 1 {
+		t.Fatalf("created = %v, calls = %v, want one create", created, fake.routesCalled())
+	}
+	for key, value := range map[string]string{"vmid": "100", "name": "web1", "memory": "2048", "scsi0": "local-lvm:8,format=raw"} {
+		if creates[0].form.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, creates[0].form.Get(key), value)
+		}
+	}
+}
+
+func TestEnsureVmUpdate(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.resources(fakeVm(100, "pve2", "running"))
+	fake.answer("GET /nodes/pve2/qemu/100/config", diffVmConfig)
+	fake.answer("GET /nodes/pve2/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images"})
+	fake.okTask("POST /nodes/pve2/qemu/100/config", "pve2")
+	fake.answer("GET /nodes/pve2/qemu/100/pending", []interface{}{
+		map[string]interface{}{"key": "memory", "value": float64(2048)},
+	})
+	current, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.Memory = 4096
+	// Created on pve1, migrated to pve2 since.
+	vmr := qemuVmRef(100, "pve1")
+	created, err := desired.EnsureVm(vmr, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created || vmr.Node() != "pve2" {
+		t.Errorf("created = %v, node = %s, want an update on pve2", created, vmr.Node())
+	}
+	updates := fake.callsTo("POST /nodes/pve2/qemu/100/config")
+	if len(updates) != 1 || updates[0].form.Get("memory") != "4096" || len(updates[0].form) != 1 {
+		t.Errorf("updates = %v, want only memory=4096", updates)
+	}
+	if creates := fake.callsTo("POST /nodes/pve2/qemu"); len(creates) != 0 {
+		t.Errorf("existing VM created again")
+	}
+}
+
+func TestEnsureVmNotQemu(t *testing.T) {
+	client, fake := newFakeClient(t)
+	container := fakeVm(100, "pve1", "running")
+	container["type"] = "lxc"
+	fake.resources(container)
+	if _, err := (ConfigQemu{Name: "web1"}).EnsureVm(qemuVmRef(100, "pve1"), client); err == nil {
+		t.Errorf("container updated as qemu vm")
+	}
+	if len(fake.callsTo("POST /nodes/pve1/lxc/100/config")) != 0 || len(fake.callsTo("POST /nodes/pve1/qemu/100/config")) != 0 {
+		t.Errorf("calls = %v, want no config change", fake.routesCalled())
+	}
+}
+
+func TestVmRefAccessors(t *testing.T) {
+	vmr := NewVmRef(100)
+	if vmr.VmId() != 100 || vmr.Node() != "" || vmr.VmType() != "" {
+		t.Errorf("new vmr = %d %q %q", vmr.VmId(), vmr.Node(), vmr.VmType())
+	}
+	vmr.SetNode("pve1")
+	vmr.SetVmType("lxc")
+	if vmr.Node() != "pve1" || vmr.VmType() != "lxc" {
+		t.Errorf("vmr = %q %q, want pve1 lxc", vmr.Node(), vmr.VmType())
+	}
+
+	client, fake := newFakeClient(t)
+	fake.resources(fakeVm(100, "pve2", "running"))
+	vmr = NewVmRef(100)
+	if err := client.CheckVmRef(vmr); err != nil {
+		t.Fatal(err)
+	}
+	if vmr.Node() != "pve2" || vmr.VmType() != "qemu" {
+		t.Errorf("vmr = %q %q, want pve2 qemu", vmr.Node(), vmr.VmType())
+	}
+}
+
+func TestWithTaskTimeout(t *testing.T) {
+	client, fake := newFakeClient(t)
+	// The clone task is still running on the first poll.
+	upid := "UPID:pve1:0000A1B2:00C3D4E5:6543210F:qmclone:9000:root@pam:"
+	fake.answer("POST /nodes/pve1/qemu/9000/clone", upid)
+	polls := 0
+	fake.handle("GET /nodes/pve1/tasks/"+upid+"/status", func(url.Values) fakeResponse {
+		polls++
+		if polls%2 == 1 {
+			return fakeResponse{data: map[string]interface{}{"status": "running"}}
+		}
+		return fakeResponse{data: map[string]interface{}{"status": "stopped", "exitstatus": "OK"}}
+	})
+	if _, err := client.WithTaskTimeout(1).CloneQemuVm(qemuVmRef(9000, "pve1"), map[string]interface{}{"newid": 101}); err == nil {
+		t.Errorf("clone outlasting the 1s task timeout didn't time out")
+	}
+	polls = 0
+	exitStatus, err := client.WithTaskTimeout(4).CloneQemuVm(qemuVmRef(9000, "pve1"), map[string]interface{}{"newid": 101})
+	if err != nil || exitStatus != "OK" {
+		t.Errorf("exitStatus = %q, err = %v, want the clone waited for", exitStatus, err)
+	}
+	if client.taskTimeout != 0 {
+		t.Errorf("taskTimeout of the original client changed to %d", client.taskTimeout)
+	}
+}
+
+func TestRebootVm(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/reboot", "pve1")
+	exitStatus, err := client.RebootVm(qemuVmRef(100, "pve1"))
+	if err != nil || exitStatus != "OK" {
+		t.Fatalf("exitStatus = %q, err = %v", exitStatus, err)
+	}
+	if routes := fake.routesCalled(); len(routes) != 2 || routes[0] != "POST /nodes/pve1/qemu/100/status/reboot" {
+		t.Errorf("calls = %v, want only the reboot task", routes)
+	}
+
+	// The Reboot flag is config, it doesn't reboot anything.
+	reboot := false
+	params, err := ConfigQemu{Name: "web1", Reboot: &reboot}.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["reboot"] != 0 {
+		t.Errorf("reboot = %#v, want 0", params["reboot"])
+	}
+}
+
+func TestMoveQemuDiskFormat(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{"scsi0": "local:100/vm-100-disk-0.qcow2,size=8G"})
+	fake.answer("GET /nodes/pve1/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images"})
+	fake.okTask("POST /nodes/pve1/qemu/100/move_disk", "pve1")
+	_, err := client.MoveQemuDisk(qemuVmRef(100, "pve1"), "scsi0", "local-lvm", "qcow2", true)
+	if err == nil || !strings.Contains(err.Error(), "can't move scsi0 to local-lvm") {
+		t.Errorf("err = %v, want qcow2 rejected on lvmthin", err)
+	}
+	if len(fake.callsTo("POST /nodes/pve1/qemu/100/move_disk")) != 0 {
+		t.Errorf("disk moved to a storage that can't hold its format")
+	}
+
+	if _, err = client.MoveQemuDisk(qemuVmRef(100, "pve1"), "scsi0", "local-lvm", "raw", true); err != nil {
+		t.Fatal(err)
+	}
+	moves := fake.callsTo("POST /nodes/pve1/qemu/100/move_disk")
+	if len(moves) != 1 || moves[0].form.Get("format") != "raw" || moves[0].form.Get("delete") != "1" || moves[0].form.Get("storage") != "local-lvm" {
+		t.Errorf("moves = %v, want scsi0 to local-lvm as raw", moves)
+	}
+
+	if _, err = client.MoveQemuDisk(qemuVmRef(100, "pve1"), "scsi1", "local-lvm", "", false); err == nil {
+		t.Errorf("move of a missing disk accepted")
+	}
+}
+
+func TestSnapshotAndWait(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("POST /nodes/pve1/qemu/100/snapshot", fake.task("pve1", "qmsnapshot", "snapshot feature is not available"))
+	_, err := client.CreateQemuSnapshotAndWait(qemuVmRef(100, "pve1"), "s1", "", false, "", time.Minute)
+	if err == nil || !strings.Contains(err.Error(), "snapshot feature is not available") {
+		t.Errorf("err = %v, want the failed task", err)
+	}
+
+	fake.answer("POST /nodes/pve1/qemu/100/snapshot/s1/rollback", fake.task("pve1", "qmrollback", "WARNINGS: 1"))
+	exitStatus, err := client.RollbackQemuSnapshotAndWait(qemuVmRef(100, "pve1"), "s1", time.Minute)
+	if err != nil || exitStatus != "WARNINGS: 1" {
+		t.Errorf("exitStatus = %q, err = %v, want warnings taken as success", exitStatus, err)
+	}
+}
+
+func TestSnapshotAndWaitTimeout(t *testing.T) {
+	client, fake := newFakeClient(t)
+	if _, err := client.CreateQemuSnapshotAndWait(qemuVmRef(100, "pve1"), "s1", "", false, "", 0); err == nil {
+		t.Errorf("timeout 0 accepted")
+	}
+	if len(fake.routesCalled()) != 0 {
+		t.Errorf("calls = %v, want none with an invalid timeout", fake.routesCalled())
+	}
+	if seconds, _ := taskTimeoutSeconds(500 * time.Millisecond); seconds != 1 {
+		t.Errorf("500ms = %ds, want 1s", seconds)
+	}
+	if seconds, _ := taskTimeoutSeconds(90 * time.Second); seconds != 90 {
+		t.Errorf("90s = %ds", seconds)
+	}
+	fake.okTask("POST /nodes/pve1/qemu/100/snapshot/s1/rollback", "pve1")
+	if _, err := client.RollbackQemuSnapshotAndWait(qemuVmRef(100, "pve1"), "s1", 500*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigQemuFromApiPending(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/pending", []interface{}{
+		map[string]interface{}{"key": "memory", "value": float64(2048), "pending": float64(4096)},
+		map[string]interface{}{"key": "cores", "value": float64(2)},
+		map[string]interface{}{"key": "description", "value": "old web server", "delete": float64(1)},
+		map[string]interface{}{"key": "net0", "pending": "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr1"},
+		map[string]interface{}{"key": "digest", "value": "aa6ce5f0c01b9ce33e4aaeff564d4"},
+	})
+	vmPending, err := client.GetVmPendingConfig(qemuVmRef(100, "pve1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vmPending) != 5 {
+		t.Errorf("%d pending entries, want 5", len(vmPending))
+	}
+	config, err := NewConfigQemuFromApiPending(qemuVmRef(100, "pve1"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Memory != 4096 || config.QemuCores != 2 || config.Description != "" {
+		t.Errorf("memory = %d, cores = %d, description = %q, want 4096, 2 and deleted", config.Memory, config.QemuCores, config.Description)
+	}
+	if config.QemuNetworks[0]["bridge"] != "vmbr1" {
+		t.Errorf("net0 = %v, want the pending bridge vmbr1", config.QemuNetworks[0])
+	}
+}
+
+func TestUpdateConfigPendingMachine(t *testing.T) {
+	client, fake := newFakeClient(t)
+	vmConfig := map[string]interface{}{"machine": "pc-i440fx-8.1"}
+	for key, value := range diffVmConfig {
+		vmConfig[key] = value
+	}
+	fake.answer("GET /nodes/pve1/qemu/100/config", vmConfig)
+	fake.answer("GET /nodes/pve1/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images"})
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	// Memory hotplugged, the machine type waits for the restart.
+	fake.answer("GET /nodes/pve1/qemu/100/pending", []interface{}{
+		map[string]interface{}{"key": "memory", "value": float64(4096)},
+		map[string]interface{}{"key": "machine", "value": "pc-i440fx-8.1", "pending": "q35"},
+	})
+	current, err := newConfigQemuFromVmConfig(vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.Memory = 4096
+	desired.ExtraConfig["machine"] = "q35"
+	rebootKeys, err := desired.UpdateConfigPending(qemuVmRef(100, "pve1"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(rebootKeys, ",") != "machine" {
+		t.Errorf("rebootKeys = %v, want machine", rebootKeys)
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 1 || updates[0].form.Get("machine") != "q35" || updates[0].form.Get("memory") != "4096" {
+		t.Errorf("updates = %v, want machine=q35 and memory=4096", updates)
+	}
+}
+
+// VM with scsi1, which moves to unused0 once deleted.
+func fakeDetachableDisk(fake *fakeProxmox) {
+	detached := false
+	fake.handle("GET /nodes/pve1/qemu/100/config", func(url.Values) fakeResponse {
+		if detached {
+			return fakeResponse{data: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=8G", "unused0": "local-lvm:vm-100-disk-1"}}
+		}
+		return fakeResponse{data: map[string]interface{}{"scsi0": "local-lvm:vm-100-disk-0,size=8G", "scsi1": "local-lvm:vm-100-disk-1,size=16G"}}
+	})
+	upid := fake.task("pve1", "qmconfig", "OK")
+	fake.handle("POST /nodes/pve1/qemu/100/config", func(form url.Values) fakeResponse {
+		detached = detached || form.Get("delete") == "scsi1"
+		return fakeResponse{data: upid}
+	})
+}
+
+func TestDetachQemuDisk(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeDetachableDisk(fake)
+	if _, err := client.DetachQemuDisk(qemuVmRef(100, "pve1"), "scsi1", false); err != nil {
+		t.Fatal(err)
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 1 || updates[0].form.Get("delete") != "scsi1" {
+		t.Errorf("updates = %v, want only delete=scsi1", updates)
+	}
+	if _, err := client.DetachQemuDisk(qemuVmRef(100, "pve1"), "scsi2", false); err == nil {
+		t.Errorf("detach of a missing disk accepted")
+	}
+}
+
+func TestDetachQemuDiskDestroy(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeDetachableDisk(fake)
+	if _, err := client.DetachQemuDisk(qemuVmRef(100, "pve1"), "scsi1", true); err != nil {
+		t.Fatal(err)
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 2 || updates[0].form.Get("delete") != "scsi1" || updates[1].form.Get("delete") != "unused0" {
+		t.Errorf("updates = %v, want delete=scsi1 then delete=unused0", updates)
+	}
+}
+
+func TestRenameVm(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	if _, err := client.RenameVm(qemuVmRef(100, "pve1"), "web1.example.com"); err != nil {
+		t.Fatal(err)
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 1 || updates[0].form.Get("name") != "web1.example.com" || len(updates[0].form) != 1 {
+		t.Errorf("updates = %v, want only name=web1.example.com", updates)
+	}
+	for _, name := range []string{"web_1", "web 1", "-web1", "web1-", "web1..example", ""} {
+		if _, err := client.RenameVm(qemuVmRef(100, "pve1"), name); err == nil {
+			t.Errorf("name %q accepted", name)
+		}
+		if _, err := (ConfigQemu{Name: name}).BuildCreateParams(NewVmRef(100)); err == nil && name != "" {
+			t.Errorf("create with name %q accepted", name)
+		}
+	}
+	if len(fake.callsTo("POST /nodes/pve1/qemu/100/config")) != 1 {
+		t.Errorf("invalid names sent to Proxmox")
+	}
+}
+
+func TestSetVmDescription(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	if _, err := client.SetVmDescription(qemuVmRef(100, "pve1"), "web server, rack 4"); err != nil {
+		t.Fatal(err)
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 1 || updates[0].form.Get("description") != "web server, rack 4" || len(updates[0].form) != 1 {
+		t.Errorf("updates = %v, want only the description", updates)
+	}
+}
+
+func fakeClone(fake *fakeProxmox) {
+	fake.okTask("POST /nodes/pve1/qemu/9000/clone", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/101/config", map[string]interface{}{
+		"name":  "web1",
+		"scsi0": "local-lvm:base-9000-disk-0/vm-101-disk-0,size=8G",
+	})
+	fake.okTask("POST /nodes/pve1/qemu/101/config", "pve1")
+}
+
+func TestCloneVmType(t *testing.T) {
+	tests := []struct {
+		cloneType CloneType
+		full      string
+		storage   string
+	}{
+		{CloneFull, "1", "ceph"},
+		{CloneLinked, "0", ""},
+	}
+	for _, test := range tests {
+		client, fake := newFakeClient(t)
+		fakeClone(fake)
+		config := ConfigQemu{Name: "web1", Storage: "ceph"}
+		config.SetCloneType(test.cloneType)
+		if config.GetCloneType() != test.cloneType {
+			t.Errorf("GetCloneType = %v, want %v", config.GetCloneType(), test.cloneType)
+		}
+		if err := config.CloneVm(qemuVmRef(9000, "pve1"), qemuVmRef(101, "pve1"), client); err != nil {
+			t.Fatal(err)
+		}
+		clones := fake.callsTo("POST /nodes/pve1/qemu/9000/clone")
+		if len(clones) != 1 {
+			t.Fatalf("calls = %v, want one clone", fake.routesCalled())
+		}
+		if clones[0].form.Get("full") != test.full || clones[0].form.Get("storage") != test.storage {
+			t.Errorf("clone type %v: clone = %v, want full=%s storage=%q", test.cloneType, clones[0].form, test.full, test.storage)
+		}
+	}
+	// FullClone unset is a full clone.
+	if (ConfigQemu{}).GetCloneType() != CloneFull {
+		t.Errorf("default clone type isn't CloneFull")
+	}
+}
+
+func TestClusterNextId(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.handle("GET /cluster/nextid", func(form url.Values) fakeResponse {
+		if form.Get("vmid") == "105" {
+			return fakeResponse{status: http.StatusBadRequest, message: "Parameter verification failed."}
+		}
+		if form.Get("vmid") != "" {
+			return fakeResponse{data: form.Get("vmid")}
+		}
+		return fakeResponse{data: "106"}
+	})
+	nextID, err := client.ClusterNextId()
+	if err != nil || nextID != 106 {
+		t.Errorf("ClusterNextId = %d, %v, want 106", nextID, err)
+	}
+	if calls := fake.callsTo("GET /cluster/nextid"); len(calls) != 1 || calls[0].form.Get("vmid") != "" {
+		t.Errorf("calls = %v, want one without vmid", calls)
+	}
+	if nextID, err = client.GetNextID(110); err != nil || nextID != 110 {
+		t.Errorf("GetNextID(110) = %d, %v, want 110", nextID, err)
+	}
+	// A taken vmid falls back to the first free one.
+	if nextID, err = client.GetNextID(105); err != nil || nextID != 106 {
+		t.Errorf("GetNextID(105) = %d, %v, want 106", nextID, err)
+	}
+}
+
+func TestStartVmAndWait(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/start", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "running"})
+	if exitStatus, err := client.StartVmAndWait(qemuVmRef(100, "pve1"), time.Minute); err != nil || exitStatus != "OK" {
+		t.Errorf("StartVmAndWait = %q, %v, want OK", exitStatus, err)
+	}
+
+	// The start task succeeds but the VM doesn't come up within the custom timeout.
+	client, fake = newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/start", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "stopped"})
+	_, err := client.StartVmAndWait(qemuVmRef(100, "pve1"), 0)
+	if err == nil || !strings.Contains(err.Error(), "last status: stopped") {
+		t.Errorf("err = %v, want a timeout with the last status", err)
+	}
+}
+
+func TestStopVmForced(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/status/shutdown", "pve1")
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{"status": "stopped"})
+	forced, err := client.StopVmForced(qemuVmRef(100, "pve1"))
+	if err != nil || forced {
+		t.Errorf("forced = %v, err = %v, want a clean shutdown", forced, err)
+	}
+	shutdowns := fake.callsTo("POST /nodes/pve1/qemu/100/status/shutdown")
+	if len(shutdowns) != 1 || shutdowns[0].form.Get("timeout") != fmt.Sprint(ShutdownTimeout) {
+		t.Errorf("shutdowns = %v, want timeout=%d", shutdowns, ShutdownTimeout)
+	}
+	if calls := fake.callsTo("POST /nodes/pve1/qemu/100/status/stop"); len(calls) != 0 {
+		t.Errorf("VM hard stopped after a clean shutdown")
+	}
+}
+
+func TestReadBackQemuDisks(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{
+		"scsi0":   "local-lvm:vm-100-disk-0,size=8G",
+		"virtio1": "ceph:vm-100-disk-3,size=32G",
+	})
+	config := ConfigQemu{QemuDisks: QemuDevices{
+		0: {"type": "scsi", "storage": "local-lvm", "size": "8G"},
+		1: {"type": "virtio", "storage": "ceph", "size": "32G"},
+	}}
+	disks, err := config.ReadBackQemuDisks(qemuVmRef(100, "pve1"), client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for diskID, file := range map[int]string{0: "vm-100-disk-0", 1: "vm-100-disk-3"} {
+		if disks[diskID]["file"] != file {
+			t.Errorf("disk %d = %v, want file %s", diskID, disks[diskID], file)
+		}
+	}
+	if _, isSet := config.QemuDisks[1]["file"]; isSet {
+		t.Errorf("config changed: %v", config.QemuDisks)
+	}
+
+	// A disk of another type on the same index wasn't created.
+	config.QemuDisks[1]["type"] = "sata"
+	if _, err = config.ReadBackQemuDisks(qemuVmRef(100, "pve1"), client); err == nil || !strings.Contains(err.Error(), "sata1") {
+		t.Errorf("err = %v, want sata1 not found", err)
+	}
+}
+
+func TestWaitForGuestAgent(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("POST /nodes/pve1/qemu/100/agent/ping", nil)
+	if err := client.WaitForGuestAgent(qemuVmRef(100, "pve1"), time.Minute); err != nil {
+		t.Error(err)
+	}
+
+	client, fake = newFakeClient(t)
+	fake.handle("POST /nodes/pve1/qemu/100/agent/ping", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusInternalServerError, message: "QEMU guest agent is not running"}
+	})
+	err := client.WaitForGuestAgent(qemuVmRef(100, "pve1"), 0)
+	if err == nil || !strings.Contains(err.Error(), "not responding") || !strings.Contains(err.Error(), "QEMU guest agent is not running") {
+		t.Errorf("err = %v, want a timeout with the last error", err)
+	}
+}
+
+func TestGetVncProxy(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("POST /nodes/pve1/qemu/100/vncproxy", map[string]interface{}{
+		"port":   "5900",
+		"ticket": "PVEVNC:6543210F::c2lnbmF0dXJl",
+		"user":   "root@pam",
+		"cert":   "-----BEGIN CERTIFICATE-----",
+		"upid":   "UPID:pve1:0000A1B2:00C3D4E5:6543210F:vncproxy:100:root@pam:",
+	})
+	vncProxy, err := client.GetVncProxy(qemuVmRef(100, "pve1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := VncProxy{
+		Ticket: "PVEVNC:6543210F::c2lnbmF0dXJl",
+		Port:   5900,
+		User:   "root@pam",
+		Cert:   "-----BEGIN CERTIFICATE-----",
+		Upid:   "UPID:pve1:0000A1B2:00C3D4E5:6543210F:vncproxy:100:root@pam:",
+	}
+	if vncProxy != want {
+		t.Errorf("GetVncProxy = %+v, want %+v", vncProxy, want)
+	}
+}
+
+func TestGetSpiceProxy(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("POST /nodes/pve1/qemu/100/spiceproxy", map[string]interface{}{
+		"type":         "spice",
+		"host":         "pvespiceproxy:6543210f:100:pve1::c2lnbmF0dXJl",
+		"proxy":        "http://pve1.example.com:3128",
+		"tls-port":     float64(61000),
+		"password":     "6f2b8d1e",
+		"host-subject": "OU=PVE Cluster Node,O=Proxmox Virtual Environment,CN=pve1.example.com",
+		"ca":           "-----BEGIN CERTIFICATE-----",
+		"title":        "VM 100 - web1",
+	})
+	spiceProxy, err := client.GetSpiceProxy(qemuVmRef(100, "pve1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := SpiceProxy{
+		Type:        "spice",
+		Host:        "pvespiceproxy:6543210f:100:pve1::c2lnbmF0dXJl",
+		Proxy:       "http://pve1.example.com:3128",
+		TlsPort:     61000,
+		Password:    "6f2b8d1e",
+		HostSubject: "OU=PVE Cluster Node,O=Proxmox Virtual Environment,CN=pve1.example.com",
+		CA:          "-----BEGIN CERTIFICATE-----",
+		Title:       "VM 100 - web1",
+	}
+	if spiceProxy != want {
+		t.Errorf("GetSpiceProxy = %+v, want %+v", spiceProxy, want)
+	}
+
+	// No SPICE display.
+	fake.handle("POST /nodes/pve1/qemu/100/spiceproxy", func(url.Values) fakeResponse {
+		return fakeResponse{status: http.StatusInternalServerError, message: "VM 100 not running"}
+	})
+	if _, err = client.GetSpiceProxy(qemuVmRef(100, "pve1")); err == nil {
+		t.Errorf("error not returned")
+	}
+}
+
+func TestGetClusterResources(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.resources(
+		map[string]interface{}{
+			"id": "qemu/100", "type": "qemu", "vmid": float64(100), "node": "pve1", "name": "web1",
+			"status": "running", "tags": "env-prod;web", "maxmem": float64(2147483648), "maxdisk": float64(8589934592),
+		},
+		map[string]interface{}{
+			"id": "lxc/9000", "type": "lxc", "vmid": float64(9000), "node": "pve2", "name": "base",
+			"status": "stopped", "template": float64(1),
+		},
+		map[string]interface{}{"id": "storage/pve1/local-lvm", "type": "storage", "node": "pve1", "storage": "local-lvm", "status": "available"},
+		map[string]interface{}{"id": "node/pve1", "type": "node", "node": "pve1", "status": "online"},
+	)
+	resources, err := client.GetClusterResources("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []ClusterResource{
+		{ID: "qemu/100", Type: "qemu", VmId: 100, Node: "pve1", Name: "web1", Status: "running", Tags: "env-prod;web", MaxMem: 2147483648, MaxDisk: 8589934592},
+		{ID: "lxc/9000", Type: "lxc", VmId: 9000, Node: "pve2", Name: "base", Status: "stopped", Template: true},
+		{ID: "storage/pve1/local-lvm", Type: "storage", Node: "pve1", Storage: "local-lvm", Status: "available"},
+		{ID: "node/pve1", Type: "node", Node: "pve1", Status: "online"},
+	}
+	if len(resources) != len(want) {
+		t.Fatalf("resources = %+v, want %d", resources, len(want))
+	}
+	for ii := range want {
+		if resources[ii] != want[ii] {
+			t.Errorf("resource %d = %+v, want %+v", ii, resources[ii], want[ii])
+		}
+	}
+
+	if _, err = client.GetClusterResources("vm"); err != nil {
+		t.Fatal(err)
+	}
+	calls := fake.callsTo("GET /cluster/resources")
+	if len(calls) != 2 || calls[0].form.Get("type") != "" || calls[1].form.Get("type") != "vm" {
+		t.Errorf("calls = %v, want the type filter only on the second", calls)
+	}
+}
+
+func TestResizeQemuDiskMissing(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{
+		"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+		"scsi1": "local-lvm:vm-100-disk-1,size=32G",
+		"ide2":  "local:iso/install.iso,media=cdrom",
+		"net0":  "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr0",
+	})
+	_, err := client.ResizeQemuDisk(qemuVmRef(100, "pve1"), "virtio0", 2)
+	want := "disk 'virtio0' not found on vm 100, it has: scsi0, scsi1"
+	if err == nil || err.Error() != want {
+		t.Errorf("err = %v, want %s", err, want)
+	}
+	if calls := fake.callsTo("PUT /nodes/pve1/qemu/100/resize"); len(calls) != 0 {
+		t.Errorf("missing disk resized")
+	}
+}
+
+func TestGetMigrationStatus(t *testing.T) {
+	client, fake := newFakeClient(t)
+	upid := "UPID:pve1:0000A1B2:00C3D4E5:6543210F:qmigrate:100:root@pam:"
+	fake.answer("GET /nodes/pve1/tasks", []interface{}{map[string]interface{}{"upid": upid, "type": "qmigrate"}})
+	fake.answer("GET /nodes/pve1/tasks/"+upid+"/status", map[string]interface{}{"status": "running"})
+	fake.answer("GET /nodes/pve1/tasks/"+upid+"/log", []interface{}{
+		map[string]interface{}{"n": float64(1), "t": "starting migration of VM 100 to node 'pve2' (10.0.0.2)"},
+		map[string]interface{}{"n": float64(2), "t": "migration active, transferred 512.0 MiB of 4.0 GiB VM-state, 101.1 MiB/s"},
+		map[string]interface{}{"n": float64(3), "t": "migration active, transferred 1.0 GiB of 4.0 GiB VM-state, 99.8 MiB/s"},
+	})
+	status, err := client.GetMigrationStatus(qemuVmRef(100, "pve1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := MigrationStatus{Upid: upid, Running: true, Transferred: 1 << 30, Remaining: 3 << 30, Total: 4 << 30}
+	if status != want {
+		t.Errorf("GetMigrationStatus = %+v, want %+v", status, want)
+	}
+	calls := fake.callsTo("GET /nodes/pve1/tasks")
+	if len(calls) != 1 || calls[0].form.Get("vmid") != "100" || calls[0].form.Get("typefilter") != "qmigrate" {
+		t.Errorf("calls = %v, want the qmigrate tasks of vm 100", calls)
+	}
+
+	// Finished, logged by an older Proxmox.
+	fake.answer("GET /nodes/pve1/tasks/"+upid+"/status", map[string]interface{}{"status": "stopped", "exitstatus": "OK"})
+	fake.answer("GET /nodes/pve1/tasks/"+upid+"/log", []interface{}{
+		map[string]interface{}{"n": float64(1), "t": "migration status: active (transferred 545335578, remaining 3741528064), total 4312137728)"},
+		map[string]interface{}{"n": float64(2), "t": "TASK OK"},
+	})
+	if status, err = client.GetMigrationStatus(qemuVmRef(100, "pve1")); err != nil {
+		t.Fatal(err)
+	}
+	want = MigrationStatus{Upid: upid, ExitStatus: "OK", Transferred: 545335578, Remaining: 3741528064, Total: 4312137728}
+	if status != want {
+		t.Errorf("GetMigrationStatus = %+v, want %+v", status, want)
+	}
+
+	fake.answer("GET /nodes/pve1/tasks", []interface{}{})
+	if _, err = client.GetMigrationStatus(qemuVmRef(100, "pve1")); err == nil {
+		t.Errorf("no error without a migration task")
+	}
+}
+
+func TestImportOvf(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/storage/local/import-metadata", map[string]interface{}{
+		"type":        "vm",
+		"source":      "ova",
+		"create-args": map[string]interface{}{"name": "appliance", "cores": float64(2), "memory": float64(4096), "ostype": "l26"},
+		"disks":       map[string]interface{}{"scsi0": "local:import/appliance.ova/disk1.vmdk"},
+		"net":         map[string]interface{}{"net0": map[string]interface{}{"model": "vmxnet3"}},
+	})
+	fake.answer("GET /cluster/nextid", "105")
+	fake.okTask("POST /nodes/pve1/qemu", "pve1")
+	vmr, err := client.ImportOvf("pve1", "local:import/appliance.ova", "local-lvm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmr.VmId() != 105 || vmr.Node() != "pve1" || vmr.VmType() != "qemu" {
+		t.Errorf("vmr = %+v, want qemu 105 on pve1", vmr)
+	}
+	if calls := fake.callsTo("GET /nodes/pve1/storage/local/import-metadata"); len(calls) != 1 || calls[0].form.Get("volume") != "local:import/appliance.ova" {
+		t.Errorf("metadata calls = %v, want volume local:import/appliance.ova", calls)
+	}
+	creates := fake.callsTo("POST /nodes/pve1/qemu")
+	if len(creates) != 1 {
+		t.Fatalf("calls = %v, want one create", fake.routesCalled())
+	}
+	for key, value := range map[string]string{
+		"vmid":   "105",
+		"name":   "appliance",
+		"cores":  "2",
+		"memory": "4096",
+		"scsi0":  "local-lvm:0,import-from=local:import/appliance.ova/disk1.vmdk",
+		"net0":   "model=vmxnet3,bridge=vmbr0",
+	} {
+		if creates[0].form.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, creates[0].form.Get(key), value)
+		}
+	}
+
+	if _, err = client.ImportOvf("pve1", "appliance.ova", "local-lvm"); err == nil {
+		t.Errorf("manifest without storage accepted")
+	}
+}
+
+func TestGetVmStatus(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{
+		"status": "running", "qmpstatus": "running", "uptime": float64(3600), "cpus": float64(2), "cpu": 0.25,
+		"mem": float64(1073741824), "maxmem": float64(2147483648), "balloon": float64(2147483648), "balloon_min": float64(1073741824),
+		"ballooninfo": map[string]interface{}{"actual": float64(1610612736), "free_mem": float64(536870912)},
+	})
+	vmStatus, err := client.GetVmStatus(qemuVmRef(100, "pve1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := VmStatus{
+		Status: "running", QmpStatus: "running", Uptime: 3600, Cpus: 2, Cpu: 0.25,
+		Mem: 1073741824, MaxMem: 2147483648, Balloon: 2147483648, BalloonMin: 1073741824,
+		BalloonActual: 1610612736, FreeMem: 536870912, HasBalloonStats: true,
+	}
+	if vmStatus != want {
+		t.Errorf("GetVmStatus = %+v, want %+v", vmStatus, want)
+	}
+
+	// Stopped, or running without the balloon device.
+	fake.answer("GET /nodes/pve1/qemu/100/status/current", map[string]interface{}{
+		"status": "stopped", "qmpstatus": "stopped", "uptime": float64(0), "cpus": float64(2), "cpu": float64(0),
+		"mem": float64(0), "maxmem": float64(2147483648),
+	})
+	if vmStatus, err = client.GetVmStatus(qemuVmRef(100, "pve1")); err != nil {
+		t.Fatal(err)
+	}
+	want = VmStatus{Status: "stopped", QmpStatus: "stopped", Cpus: 2, MaxMem: 2147483648}
+	if vmStatus != want {
+		t.Errorf("GetVmStatus = %+v, want %+v", vmStatus, want)
+	}
+}
+
+func TestNewConfigQemuFromApiRaw(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{
+		"name":   "web1",
+		"digest": "eb54fb9d9f120ba0c3bdf694f73b10002c375c38",
+		"meta":   "creation-qemu=8.1.2,ctime=1700000000",
+		"ide2":   "local:iso/install.iso,media=cdrom,size=700M",
+		"scsi0":  "local-lvm:vm-100-disk-0,iothread=1,size=8G",
+	})
+	vmr := qemuVmRef(100, "pve1")
+	vmr.EnableConfigCache()
+	config, rawConfig, err := NewConfigQemuFromApiRaw(vmr, client)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Name != "web1" || config.QemuIso != "local:iso/install.iso" {
+		t.Errorf("config = %v, want web1 with the iso", config)
+	}
+	for key, value := range map[string]string{
+		"digest": "eb54fb9d9f120ba0c3bdf694f73b10002c375c38",
+		"meta":   "creation-qemu=8.1.2,ctime=1700000000",
+		"ide2":   "local:iso/install.iso,media=cdrom,size=700M",
+		"scsi0":  "local-lvm:vm-100-disk-0,iothread=1,size=8G",
+	} {
+		if rawConfig[key] != value {
+			t.Errorf("raw %s = %v, want %s", key, rawConfig[key], value)
+		}
+		if _, isSet := config.ExtraConfig[key]; isSet {
+			t.Errorf("%s in ExtraConfig too", key)
+		}
+	}
+	// The raw map is the caller's, not the cache.
+	rawConfig["name"] = "changed"
+	if config, err = NewConfigQemuFromApi(vmr, client); err != nil || config.Name != "web1" {
+		t.Errorf("Name = %q, %v, want the cached web1", config.Name, err)
+	}
+	if calls := fake.callsTo("GET /nodes/pve1/qemu/100/config"); len(calls) != 1 {
+		t.Errorf("config read %d times, want once", len(calls))
+	}
+}
+
+func TestListQemuVmsByTag(t *testing.T) {
+	client, fake := newFakeClient(t)
+	web1 := fakeVm(100, "pve1", "running")
+	web1["tags"] = "env-staging;web"
+	web2 := fakeVm(101, "pve2", "stopped")
+	web2["tags"] = "web,env-staging"
+	prod := fakeVm(102, "pve1", "running")
+	prod["tags"] = "env-staging-old;web"
+	container := fakeVm(200, "pve1", "running")
+	container["type"] = "lxc"
+	container["tags"] = "env-staging"
+	fake.resources(web1, web2, prod, container, fakeVm(103, "pve1", "running"))
+	vms, err := client.ListQemuVmsByTag("env-staging")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(vms) != 2 || vms[0].VmId != 100 || vms[1].VmId != 101 {
+		t.Errorf("vms = %+v, want 100 and 101", vms)
+	}
+	if vms, err = client.ListQemuVmsByTag("db"); err != nil || vms == nil || len(vms) != 0 {
+		t.Errorf("vms = %+v, %v, want an empty list", vms, err)
+	}
+
+	for tags, want := range map[string]bool{"web": true, "web;db": true, "db web": true, "webserver": false, "": false} {
+		if (ClusterResource{Tags: tags}).HasTag("web") != want {
+			t.Errorf("HasTag(web) of %q = %v, want %v", tags, !want, want)
+		}
+	}
+}
+
+// Status route answering one state after the other, the last one repeated.
+func fakeStatusSequence(fake *fakeProxmox, states ...map[string]interface{}) {
+	next := 0
+	fake.handle("GET /nodes/pve1/qemu/100/status/current", func(url.Values) fakeResponse {
+		state := states[next]
+		if next < len(states)-1 {
+			next++
+		}
+		return fakeResponse{data: state}
+	})
+}
+
+func TestSampleVmUsage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fakeStatusSequence(fake,
+		map[string]interface{}{"status": "running", "cpu": 0.25, "mem": float64(1000)},
+		map[string]interface{}{"status": "running", "cpu": 0.75, "mem": float64(3000)},
+		// Stopped after the second sample.
+		map[string]interface{}{"status": "stopped", "cpu": float64(0), "mem": float64(0)},
+	)
+	avgCpu, avgMem, err := client.SampleVmUsage(qemuVmRef(100, "pve1"), 4, time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if avgCpu != 0.5 || avgMem != 2000 {
+		t.Errorf("SampleVmUsage = %v, %d, want 0.5 and 2000 over the running samples", avgCpu, avgMem)
+	}
+	if calls := fake.callsTo("GET /nodes/pve1/qemu/100/status/current"); len(calls) != 4 {
+		t.Errorf("%d samples, want 4", len(calls))
+	}
+
+	client, fake = newFakeClient(t)
+	fakeStatusSequence(fake, map[string]interface{}{"status": "stopped"})
+	if _, _, err = client.SampleVmUsage(qemuVmRef(100, "pve1"), 2, time.Millisecond); err == nil {
+		t.Errorf("no error for a vm not running")
+	}
+}
+
+func TestAddNetworkInterface(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/qemu/100/config", diffVmConfig)
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	nicID, macaddr, err := client.AddNetworkInterface(qemuVmRef(100, "pve1"), NewNic().Bridge("vmbr2").Tag(30).Build())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nicID != 2 || macaddr != generateMacAddr(100, 2) {
+		t.Errorf("AddNetworkInterface = net%d, %s, want net2 with %s", nicID, macaddr, generateMacAddr(100, 2))
+	}
+	updates := fake.callsTo("POST /nodes/pve1/qemu/100/config")
+	if len(updates) != 1 || len(updates[0].form) != 1 {
+		t.Fatalf("updates = %v, want only net2", updates)
+	}
+	net2 := updates[0].form.Get("net2")
+	if !strings.HasPrefix(net2, "model=virtio,macaddr="+macaddr+",bridge=vmbr2") || !strings.Contains(net2, "tag=30") {
+		t.Errorf("net2 = %q, want a virtio nic on vmbr2 with tag 30", net2)
+	}
+}
+
+func TestCloneVmRegenerateVmGenId(t *testing.T) {
+	for _, test := range []struct {
+		config ConfigQemu
+		want   string
+	}{
+		{ConfigQemu{Name: "web1", RegenerateVmGenId: true}, "generated"},
+		{ConfigQemu{Name: "web1", RegenerateVmGenId: true, VmGenId: "c4a7e5b2-1f3d-4e8a-9b6c-0d2e4f6a8b1c"}, "c4a7e5b2-1f3d-4e8a-9b6c-0d2e4f6a8b1c"},
+		// Off by default, the clone keeps the template's.
+		{ConfigQemu{Name: "web1"}, ""},
+	} {
+		client, fake := newFakeClient(t)
+		fakeClone(fake)
+		if err := test.config.CloneVm(qemuVmRef(9000, "pve1"), qemuVmRef(101, "pve1"), client); err != nil {
+			t.Fatal(err)
+		}
+		updates := fake.callsTo("POST /nodes/pve1/qemu/101/config")
+		if len(updates) != 1 {
+			t.Fatalf("calls = %v, want one update", fake.routesCalled())
+		}
+		vmGenId := updates[0].form.Get("vmgenid")
+		switch test.want {
+		case "generated":
+			if !rxUuid.MatchString(vmGenId) {
+				t.Errorf("vmgenid = %q, want a new UUID", vmGenId)
+			}
+		default:
+			if vmGenId != test.want {
+				t.Errorf("vmgenid = %q, want %q", vmGenId, test.want)
+			}
+		}
+	}
+}
+
+func TestProvisionFromCloudImage(t *testing.T) {
+	client, fake := newFakeClient(t)
+	fake.answer("GET /nodes/pve1/storage/local-lvm/status", map[string]interface{}{"type": "lvmthin", "content": "images,rootdir"})
+	fake.okTask("POST /nodes/pve1/qemu", "pve1")
+	// The imported image keeps its own size.
+	fake.answer("GET /nodes/pve1/qemu/100/config", map[string]interface{}{
+		"scsi0": "local-lvm:vm-100-disk-0,size=2252M",
+		"ide2":  "local-lvm:vm-100-cloudinit,media=cdrom",
+	})
+	fake.okTask("PUT /nodes/pve1/qemu/100/resize", "pve1")
+	config := ConfigQemu{Name: "web1", Memory: 2048, Storage: "local-lvm", CIuser: "admin", Ipconfig0: "ip=dhcp"}
+	vmr, err := config.ProvisionFromCloudImage(qemuVmRef(100, "pve1"), client, "local:import/jammy.qcow2", 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if vmr.VmId() != 100 || vmr.VmType() != "qemu" {
+		t.Errorf("vmr = %+v, want qemu 100", vmr)
+	}
+	creates := fake.callsTo("POST /nodes/pve1/qemu")
+	if len(creates) != 1 {
+		t.Fatalf("calls = %v, want one create", fake.routesCalled())
+	}
+	for key, value := range map[string]string{
+		"scsi0":     "local-lvm:0,import-from=local:import/jammy.qcow2",
+		"ide2":      "local-lvm:cloudinit",
+		"boot":      "order=scsi0",
+		"scsihw":    "virtio-scsi-single",
+		"ciuser":    "admin",
+		"ipconfig0": "ip=dhcp",
+	} {
+		if creates[0].form.Get(key) != value {
+			t.Errorf("%s = %q, want %q", key, creates[0].form.Get(key), value)
+		}
+	}
+	// 2252M grown to 20G.
+	resizes := fake.callsTo("PUT /nodes/pve1/qemu/100/resize")
+	if len(resizes) != 1 || resizes[0].form.Get("disk") != "scsi0" || resizes[0].form.Get("size") != "+18G" {
+		t.Errorf("resizes = %v, want scsi0 +18G", resizes)
+	}
+	routes := fake.routesCalled()
+	if routes[len(routes)-1] != "GET /nodes/pve1/tasks/UPID:pve1:0000A1B2:00C3D4E5:6543210F:qmtask:100:root@pam:/status" ||
+		!strings.HasPrefix(strings.Join(routes, " "), "GET /nodes/pve1/storage/local-lvm/status POST /nodes/pve1/qemu ") {
+		t.Errorf("routes = %v, want storage check, create, then resize", routes)
+	}
+
+	if _, err = (ConfigQemu{Name: "web1"}).ProvisionFromCloudImage(qemuVmRef(100, "pve1"), client, "local:import/jammy.qcow2", 20); err == nil {
+		t.Errorf("no error without Storage")
+	}
+}
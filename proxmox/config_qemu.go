@@ -1,15 +1,16 @@
 package proxmox
 
 import (
+	cryptorand "crypto/rand"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
-	"log"
 	"math/rand"
 	"net"
 	"net/url"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -21,20 +22,99 @@ type (
 	QemuDeviceParam []string
 )
 
+// Guest OS types accepted by Proxmox as ostype (ConfigQemu.QemuOs).
+const (
+	OsTypeOther    = "other"
+	OsTypeWinXP    = "wxp"
+	OsTypeWin2000  = "w2k"
+	OsTypeWin2003  = "w2k3"
+	OsTypeWin2008  = "w2k8"
+	OsTypeWinVista = "wvista"
+	OsTypeWin7     = "win7"
+	OsTypeWin8     = "win8"
+	OsTypeWin10    = "win10"
+	OsTypeWin11    = "win11"
+	OsTypeLinux24  = "l24"
+	OsTypeLinux26  = "l26"
+	OsTypeSolaris  = "solaris"
+)
+
+var qemuOsTypes = []string{
+	OsTypeOther, OsTypeWinXP, OsTypeWin2000, OsTypeWin2003, OsTypeWin2008, OsTypeWinVista,
+	OsTypeWin7, OsTypeWin8, OsTypeWin10, OsTypeWin11, OsTypeLinux24, OsTypeLinux26, OsTypeSolaris,
+}
+
+// CloneType - how CloneVm copies the disks of the source VM
+type CloneType int
+
+const (
+	// CloneFull - independent copy of all disks, the default
+	CloneFull CloneType = iota
+	// CloneLinked - disks backed by the source's, the source must be a template
+	CloneLinked
+)
+
 // ConfigQemu - Proxmox API QEMU options
 type ConfigQemu struct {
-	Name         string      `json:"name"`
-	Description  string      `json:"desc"`
-	Onboot       bool        `json:"onboot"`
-	Memory       int         `json:"memory"`
-	Storage      string      `json:"storage"`
-	QemuOs       string      `json:"os"`
-	QemuCores    int         `json:"cores"`
-	QemuSockets  int         `json:"sockets"`
-	QemuIso      string      `json:"iso"`
+	Name        string `json:"name"`
+	Description string `json:"desc"`
+	Onboot      bool   `json:"onboot"`
+	// Boot order and delays for Onboot, e.g. "order=1,up=30,down=60".
+	Startup string `json:"startup"`
+	// Restart after a crash, Proxmox currently stores but ignores it. nil keeps the current setting.
+	Autostart *bool `json:"autostart"`
+	// Protection blocks removing the VM and its disks, nil keeps the current setting.
+	Protection *bool `json:"protection"`
+	// Operation holding the VM (backup, migrate, snapshot, ...), read-only.
+	Lock string `json:"lock"`
+	// How the VM was created, e.g. "creation-qemu=8.1.5,ctime=1712345678", read-only.
+	Meta string `json:"meta"`
+	// Reboot false makes a guest reboot shut the VM down instead, nil keeps the Proxmox default.
+	// The config flag only, to reboot a VM see Client.RebootVm.
+	Reboot      *bool  `json:"reboot"`
+	Memory      int    `json:"memory"`
+	Storage     string `json:"storage"`
+	QemuOs      string `json:"os"`
+	QemuCores   int    `json:"cores"`
+	QemuSockets int    `json:"sockets"`
+	// CPU type, host when empty on create.
+	QemuCpu string `json:"cpu"`
+	// CPU flags to enable (+aes) or disable (-pcid), sent as cpu=host,flags=+aes;-pcid.
+	QemuCpuFlags []string `json:"cpu_flags"`
+	Affinity     string   `json:"affinity"`
+	// Agent 1 enables the QEMU guest agent device, needed by the Client.*Agent* methods.
+	Agent   int    `json:"agent"`
+	VmGenId string `json:"vmgenid"`
+	// Raw arguments appended to the kvm command line, e.g. "-device virtio-rng-pci".
+	// Proxmox only lets root@pam set it, as it can reach anything on the host. Only pass trusted input.
+	Args string `json:"args"`
+	// Script run on VM lifecycle events, a snippets volume like local:snippets/hook.sh.
+	HookScript string `json:"hookscript"`
+	// Devices that can be added to a running VM, e.g. "network,disk,usb,memory,cpu", "0" for none.
+	// memory needs numa=1 and a Memory aligned with AlignHotplugMemory.
+	Hotplug string `json:"hotplug"`
+	QemuIso string `json:"iso"`
+	// Devices to boot from in order, e.g. ["scsi0", "ide2", "net0"], sent as boot=order=scsi0;ide2;net0.
+	// The legacy boot=cdn with bootdisk is read into the same list, nil keeps the Proxmox default.
+	BootOrder []string `json:"boot_order"`
+	// SCSI controller, e.g. virtio-scsi-pci. On create it defaults to virtio-scsi-single
+	// when a disk has iothread, which needs a controller per disk.
+	Scsihw       string      `json:"scsihw"`
 	QemuDisks    QemuDevices `json:"disk"`
 	QemuNetworks QemuDevices `json:"network"`
-	FullClone    *int        `json:"fullclone"`
+	// PCI passthrough, "host" is the PCI id, "mdev" a mediated device type (vGPU profile).
+	QemuPCIDevices QemuDevices `json:"hostpci"`
+	// Volumes detached from the VM but still on the storage, read-only.
+	QemuUnusedDisks QemuDevices `json:"unused_disk"`
+	// Nil or 1 for a full clone, 0 for a linked clone, see GetCloneType/SetCloneType.
+	// Only used by CloneVm: Proxmox doesn't keep it, configs read from the API leave it nil.
+	FullClone *int `json:"fullclone"`
+	// RegenerateMacs replaces set MACs with the ones generated from the vmid, on clone
+	// also the MACs inherited from the template. The new MACs are written back into QemuNetworks.
+	RegenerateMacs bool `json:"regenerate_macs"`
+	// RegenerateVmGenId gives a clone a new vmgenid unless VmGenId is set, so cloned
+	// Windows guests (AD domain controllers) notice they are a copy.
+	RegenerateVmGenId bool `json:"regenerate_vmgenid"`
 	// Deprecated.
 	QemuNicModel string  `json:"nic"`
 	QemuBrige    string  `json:"bridge"`
@@ -52,164 +132,1209 @@ type ConfigQemu struct {
 	// arrays are hard, support 2 interfaces for now
 	Ipconfig0 string `json:"ipconfig0"`
 	Ipconfig1 string `json:"ipconfig1"`
+
+	// Raw Proxmox options not modeled above, sent as is on create/update.
+	// They are applied last, so they override the typed fields for the same key.
+	ExtraConfig map[string]interface{} `json:"extra_config"`
 }
 
 func (config ConfigQemu) CreateVm(vmr *VmRef, client *Client) (err error) {
+	if err = vmr.checkNode(); err != nil {
+		return
+	}
+	if config.QemuDisks, err = config.QemuDisks.withStorageTypes(vmr.node, client); err != nil {
+		return
+	}
+	if err = config.checkStorageContent(vmr.node, client); err != nil {
+		return
+	}
+	params, err := config.BuildCreateParams(vmr)
+	if err != nil {
+		return
+	}
 	vmr.SetVmType("qemu")
 
-	params := map[string]interface{}{
+	_, err = client.CreateQemuVm(vmr.node, params)
+	return
+}
+
+// ProvisionFromCloudImage - create the VM from a cloud image (e.g. local:import/jammy.qcow2):
+// the image is imported as scsi0 on Storage and grown to rootSizeGB, with a cloud-init drive
+// on ide2 for the CI* options and the VM booting from scsi0. QemuDisks are added as extra disks.
+func (config ConfigQemu) ProvisionFromCloudImage(vmr *VmRef, client *Client, imageVolid string, rootSizeGB int) (*VmRef, error) {
+	storage := config.Storage
+	if storage == "" {
+		return nil, errors.New("cloud image provisioning needs Storage for the imported disk")
+	}
+	if config.QemuIso != "" {
+		return nil, errors.New("cloud image provisioning uses ide2 for cloud-init, leave QemuIso empty")
+	}
+	if disk, isSet := config.QemuDisks[0]; isSet && disk["type"] == "scsi" {
+		return nil, errors.New("cloud image provisioning imports the image as scsi0, number the other scsi disks from 1")
+	}
+	if err := vmr.checkNode(); err != nil {
+		return nil, err
+	}
+	var err error
+	if config.QemuDisks, err = config.QemuDisks.withStorageTypes(vmr.node, client); err != nil {
+		return nil, err
+	}
+	if err = config.checkStorageContent(vmr.node, client); err != nil {
+		return nil, err
+	}
+	if config.Scsihw == "" {
+		config.Scsihw = "virtio-scsi-single"
+	}
+	// Storage would also add the deprecated single disk.
+	config.Storage = ""
+	params, err := config.BuildCreateParams(vmr)
+	if err != nil {
+		return nil, err
+	}
+	params["scsi0"] = fmt.Sprintf("%s:0,import-from=%s", storage, imageVolid)
+	params["ide2"] = storage + ":cloudinit"
+	config.cloudInitParams(params)
+	if _, isSet := params["boot"]; !isSet {
+		params["boot"] = "order=scsi0"
+	}
+	vmr.SetVmType("qemu")
+	if _, err = client.CreateQemuVm(vmr.node, params); err != nil {
+		return nil, err
+	}
+	if err = client.growQemuDisk(vmr, "scsi0", rootSizeGB); err != nil {
+		return nil, err
+	}
+	return vmr, nil
+}
+
+// BuildCreateParams - the params CreateVm sends to Proxmox, without calling the API
+func (config ConfigQemu) BuildCreateParams(vmr *VmRef) (params map[string]interface{}, err error) {
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+
+	params = map[string]interface{}{
 		"vmid":        vmr.vmId,
 		"name":        config.Name,
-		"onboot":      config.Onboot,
-		"ide2":        config.QemuIso + ",media=cdrom",
+		"onboot":      Btoi(config.Onboot),
 		"ostype":      config.QemuOs,
 		"sockets":     config.QemuSockets,
 		"cores":       config.QemuCores,
-		"cpu":         "host",
+		"cpu":         config.cpuParam(),
 		"memory":      config.Memory,
 		"description": config.Description,
+		"affinity":    config.Affinity,
+		"agent":       config.Agent,
+		"vmgenid":     config.VmGenId,
+		"args":        config.Args,
+		"hookscript":  config.HookScript,
+		"hotplug":     config.Hotplug,
+		"startup":     config.Startup,
+		"scsihw":      config.Scsihw,
+	}
+	// Leave unset options out so Proxmox applies its own defaults.
+	for key, value := range params {
+		if value == "" || value == 0 {
+			delete(params, key)
+		}
+	}
+	params["onboot"] = Btoi(config.Onboot)
+	if config.Scsihw == "" && config.hasIothread() {
+		logger.Printf("vm %d: disk with iothread, using scsihw virtio-scsi-single", vmr.vmId)
+		params["scsihw"] = "virtio-scsi-single"
+	}
+	if config.QemuIso != "" {
+		params["ide2"] = config.QemuIso + ",media=cdrom"
+	}
+	if config.Reboot != nil {
+		params["reboot"] = Btoi(*config.Reboot)
+	}
+	if config.Autostart != nil {
+		params["autostart"] = Btoi(*config.Autostart)
+	}
+	if config.Protection != nil {
+		params["protection"] = Btoi(*config.Protection)
+	}
+	if len(config.BootOrder) > 0 {
+		params["boot"] = config.bootParam()
+	}
+
+	// Create disks config.
+	if err = config.CreateQemuDisksParams(vmr.vmId, "create", params); err != nil {
+		return nil, err
+	}
+
+	// Create networks config.
+	if err = config.CreateQemuNetworksParams(vmr.vmId, params); err != nil {
+		return nil, err
+	}
+
+	// Create PCI devices config.
+	if err = config.CreateQemuPCIsParams(params); err != nil {
+		return nil, err
+	}
+
+	for key, value := range config.ExtraConfig {
+		params[key] = value
+	}
+	return
+}
+
+var (
+	rxCpuSet  = regexp.MustCompile(`^\d+(-\d+)?(,\d+(-\d+)?)*$`)
+	rxUuid    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	rxDnsName = regexp.MustCompile(`^(([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])\.)*([a-zA-Z0-9]|[a-zA-Z0-9][a-zA-Z0-9-]*[a-zA-Z0-9])$`)
+	// Hookscripts have to live on a storage with the snippets content type.
+	rxHookScript = regexp.MustCompile(`^[a-zA-Z][\w.-]*:snippets/\S+$`)
+	rxWwn        = regexp.MustCompile(`^0x[0-9a-fA-F]{16}$`)
+	rxBootDevice = regexp.MustCompile(`^(ide|sata|scsi|virtio|net|hostpci|usb)\d+$`)
+)
+
+// Proxmox only accepts DNS names as VM name.
+func validateVmName(name string) error {
+	if !rxDnsName.MatchString(name) {
+		return fmt.Errorf("invalid name '%s', expected a DNS name like vm1.example.com", name)
+	}
+	return nil
+}
+
+// Validate - check options locally before sending them to Proxmox
+func (config ConfigQemu) Validate() error {
+	if config.Name != "" {
+		if err := validateVmName(config.Name); err != nil {
+			return err
+		}
+	}
+	if config.QemuOs != "" && !inArray(qemuOsTypes, config.QemuOs) {
+		return fmt.Errorf("invalid os '%s', expected one of: %s", config.QemuOs, strings.Join(qemuOsTypes, ", "))
+	}
+	if config.Affinity != "" && !rxCpuSet.MatchString(config.Affinity) {
+		return fmt.Errorf("invalid affinity '%s', expected a host cpu list like 0-3,8-11", config.Affinity)
+	}
+	for _, flag := range config.QemuCpuFlags {
+		if len(flag) < 2 || (flag[0] != '+' && flag[0] != '-') {
+			return fmt.Errorf("invalid cpu flag '%s', expected +flag or -flag", flag)
+		}
+	}
+	if config.VmGenId != "" && !rxUuid.MatchString(config.VmGenId) {
+		return fmt.Errorf("invalid vmgenid '%s', expected a UUID, see GenerateVmGenId", config.VmGenId)
+	}
+	if config.HookScript != "" && !rxHookScript.MatchString(config.HookScript) {
+		return fmt.Errorf("invalid hookscript '%s', expected a snippets volume like local:snippets/hook.sh", config.HookScript)
+	}
+	if config.Startup != "" {
+		if !config.Onboot {
+			return fmt.Errorf("startup '%s' only applies to VMs started on boot, set onboot as well", config.Startup)
+		}
+		for _, option := range strings.Split(config.Startup, ",") {
+			keyValue := strings.SplitN(option, "=", 2)
+			if len(keyValue) != 2 || !inArray([]string{"order", "up", "down"}, keyValue[0]) {
+				return fmt.Errorf("invalid startup '%s', expected order=N,up=N,down=N", config.Startup)
+			}
+			if _, err := strconv.Atoi(keyValue[1]); err != nil {
+				return fmt.Errorf("invalid startup '%s', %s is not a number", config.Startup, keyValue[0])
+			}
+		}
+	}
+	for _, device := range config.BootOrder {
+		if !rxBootDevice.MatchString(device) {
+			return fmt.Errorf("invalid boot device '%s', expected a disk, net or hostpci device like scsi0", device)
+		}
+	}
+	for nicID, ipconfig := range []string{config.Ipconfig0, config.Ipconfig1} {
+		if ipconfig == "" {
+			continue
+		}
+		if _, err := ParseQemuIpConfig(ipconfig); err != nil {
+			return fmt.Errorf("ipconfig%d: %v", nicID, err)
+		}
+	}
+	if config.hotplugs("memory") && config.Memory > 0 && config.Memory != AlignHotplugMemory(config.Memory) {
+		return fmt.Errorf("memory %d can't be hotplugged, expected at least 1024 and a multiple of 512 like %d",
+			config.Memory, AlignHotplugMemory(config.Memory))
+	}
+	if config.QemuVlanTag > 0 && !validVlanID(strconv.Itoa(config.QemuVlanTag)) {
+		return fmt.Errorf("invalid vlan %d, expected 1-4094", config.QemuVlanTag)
+	}
+	for nicID, nicConfMap := range config.QemuNetworks {
+		if tag, isSet := nicConfMap["tag"]; isSet && tag != 0 && tag != "" {
+			if !validVlanID(fmt.Sprintf("%v", tag)) {
+				return fmt.Errorf("invalid tag '%v' on net%d, expected 1-4094", tag, nicID)
+			}
+		}
+		if trunks, isSet := nicConfMap["trunks"]; isSet && trunks != "" {
+			if trunkList, ok := trunks.([]string); ok {
+				trunks = strings.Join(trunkList, ";")
+			}
+			for _, trunk := range strings.Split(fmt.Sprintf("%v", trunks), ";") {
+				if !validVlanID(trunk) {
+					return fmt.Errorf("invalid trunks '%v' on net%d, expected vlan ids (1-4094) separated by ;", trunks, nicID)
+				}
+			}
+		}
+	}
+	for diskID, diskConfMap := range config.QemuDisks {
+		storageType, _ := diskConfMap["storage_type"].(string)
+		format, _ := diskConfMap["format"].(string)
+		if _, err := diskFormat(storageType, format); err != nil {
+			return fmt.Errorf("disk %v%d: %v", diskConfMap["type"], diskID, err)
+		}
+		if wwn, isSet := diskConfMap["wwn"]; isSet && !rxWwn.MatchString(fmt.Sprintf("%v", wwn)) {
+			return fmt.Errorf("invalid wwn '%v' on disk %v%d, expected 0x and 16 hex digits", wwn, diskConfMap["type"], diskID)
+		}
+	}
+	return nil
+}
+
+// Does any disk ask for its own I/O thread?
+func (config ConfigQemu) hasIothread() bool {
+	for _, disk := range config.QemuDisks {
+		if iothread, isSet := disk["iothread"]; isSet && apiBool(iothread) {
+			return true
+		}
+	}
+	return false
+}
+
+// Is device (network, disk, usb, memory, cpu) listed in Hotplug?
+func (config ConfigQemu) hotplugs(device string) bool {
+	return inArray(strings.Split(config.Hotplug, ","), device)
+}
+
+// AlignHotplugMemory - memory in MB rounded up to a size memory hotplug accepts:
+// at least 1024 (the static part) and added in 512 MB dimms.
+func AlignHotplugMemory(memory int) int {
+	if memory < 1024 {
+		return 1024
+	}
+	return (memory + 511) / 512 * 512
+}
+
+func validVlanID(vlan string) bool {
+	id, err := strconv.Atoi(vlan)
+	return err == nil && id >= 1 && id <= 4094
+}
+
+// GenerateVmGenId - random (version 4) UUID for ConfigQemu.VmGenId
+func GenerateVmGenId() (string, error) {
+	uuid := make([]byte, 16)
+	if _, err := cryptorand.Read(uuid); err != nil {
+		return "", err
+	}
+	uuid[6] = (uuid[6] & 0x0f) | 0x40
+	uuid[8] = (uuid[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", uuid[0:4], uuid[4:6], uuid[6:8], uuid[8:10], uuid[10:16]), nil
+}
+
+// TotalDiskGB - provisioned size of all disks, cdrom and cloud-init drives excluded
+func (config ConfigQemu) TotalDiskGB() float64 {
+	// For backward compatibility.
+	if len(config.QemuDisks) == 0 {
+		return config.DiskSize
+	}
+	total := 0.0
+	for _, diskConfMap := range config.QemuDisks {
+		if diskConfMap["media"] == "cdrom" {
+			continue
+		}
+		if file, _ := diskConfMap["file"].(string); strings.Contains(file, "cloudinit") {
+			continue
+		}
+		if size, err := diskSizeGB(diskConfMap["size"]); err == nil {
+			total += size
+		}
+	}
+	return total
+}
+
+var diskSizeUnits = map[string]float64{"K": 1.0 / 1024 / 1024, "M": 1.0 / 1024, "G": 1, "T": 1024}
+
+// Disk size in GB from values like 32G, 512M or 1T, plain numbers are GB.
+func diskSizeGB(size interface{}) (float64, error) {
+	switch v := size.(type) {
+	case float64:
+		return v, nil
+	case int:
+		return float64(v), nil
+	case string:
+		sizeStr := strings.TrimSpace(v)
+		multiplier := 1.0
+		if n := len(sizeStr); n > 0 {
+			if unit, isUnit := diskSizeUnits[strings.ToUpper(sizeStr[n-1:])]; isUnit {
+				multiplier = unit
+				sizeStr = sizeStr[:n-1]
+			}
+		}
+		value, err := strconv.ParseFloat(sizeStr, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid disk size '%s'", v)
+		}
+		return value * multiplier, nil
+	}
+	return 0, fmt.Errorf("invalid disk size '%v'", size)
+}
+
+// Disk size read from the API as NG, like the sizes ConfigQemu takes.
+// Proxmox mostly returns 32G or 512M, some storages report plain bytes.
+func normalizeDiskSize(size interface{}) (string, error) {
+	var sizeGB float64
+	if bytes, isInt := size.(int); isInt {
+		sizeGB = float64(bytes) / 1024 / 1024 / 1024
+	} else {
+		var err error
+		if sizeGB, err = diskSizeGB(size); err != nil {
+			return "", err
+		}
+	}
+	return strconv.FormatFloat(sizeGB, 'f', -1, 64) + "G", nil
+}
+
+// Only the order= format, the legacy boot=cdn is deprecated.
+func (config ConfigQemu) bootParam() string {
+	return "order=" + strings.Join(config.BootOrder, ";")
+}
+
+// Boot order from either boot=order=scsi0;net0 or the legacy boot=cdn (disk, cdrom, network) with bootdisk.
+func parseBootOrder(vmConfig map[string]interface{}) []string {
+	boot, _ := vmConfig["boot"].(string)
+	bootdisk, _ := vmConfig["bootdisk"].(string)
+	if strings.HasPrefix(boot, "order=") {
+		return strings.FieldsFunc(strings.TrimPrefix(boot, "order="), func(r rune) bool { return r == ';' })
+	}
+	if boot == "" {
+		if bootdisk == "" {
+			return nil
+		}
+		// Proxmox defaults to cdn.
+		boot = "cdn"
+	}
+	bootOrder := []string{}
+	for _, device := range boot {
+		switch device {
+		case 'c':
+			if bootdisk != "" {
+				bootOrder = append(bootOrder, bootdisk)
+			}
+		case 'd':
+			if ide2, _ := vmConfig["ide2"].(string); strings.Contains(ide2, "media=cdrom") {
+				bootOrder = append(bootOrder, "ide2")
+			}
+		case 'n':
+			nicIDs := []int{}
+			for key := range vmConfig {
+				if rxNicName.MatchString(key) {
+					nicID, _ := strconv.Atoi(rxDeviceID.FindString(key))
+					nicIDs = append(nicIDs, nicID)
+				}
+			}
+			sort.Ints(nicIDs)
+			for _, nicID := range nicIDs {
+				bootOrder = append(bootOrder, fmt.Sprintf("net%d", nicID))
+			}
+		}
+	}
+	return bootOrder
+}
+
+func (config ConfigQemu) cpuParam() string {
+	cpu := config.QemuCpu
+	if cpu == "" {
+		cpu = "host"
+	}
+	if len(config.QemuCpuFlags) > 0 {
+		cpu += ",flags=" + strings.Join(config.QemuCpuFlags, ";")
+	}
+	return cpu
+}
+
+// Windows ostypes all start with w (wxp, w2k, win10, ...).
+func (config ConfigQemu) isWindows() bool {
+	return strings.HasPrefix(config.QemuOs, "w")
+}
+
+// WindowsOptimize - recommended settings for a Windows guest: cpu type host,
+// cpu flag +hv-tlbflush and machine q35 (in ExtraConfig, unless already set).
+// Proxmox adds the base Hyper-V enlightenments (hv_relaxed, hv_vapic, hv_spinlocks,
+// hv_time, ...) by itself when QemuOs is a Windows type, so set that as well.
+func (config *ConfigQemu) WindowsOptimize() {
+	config.QemuCpu = "host"
+	if !inArray(config.QemuCpuFlags, "+hv-tlbflush") {
+		config.QemuCpuFlags = append(config.QemuCpuFlags, "+hv-tlbflush")
+	}
+	if config.ExtraConfig == nil {
+		config.ExtraConfig = map[string]interface{}{}
+	}
+	if _, isSet := config.ExtraConfig["machine"]; !isSet {
+		config.ExtraConfig["machine"] = "q35"
+	}
+}
+
+// HasCloudInit - are there cloud-init options?
+func (config ConfigQemu) HasCloudInit() bool {
+	return config.CIuser != "" ||
+		config.CIpassword != "" ||
+		config.Searchdomain != "" ||
+		config.Nameserver != "" ||
+		config.Sshkeys != "" ||
+		config.Ipconfig0 != "" ||
+		config.Ipconfig1 != ""
+}
+
+// ConfigQemu without its methods, for printing.
+type configQemuPrint ConfigQemu
+
+// Copy of config with the cloud-init secrets masked.
+func (config ConfigQemu) redacted() configQemuPrint {
+	if config.CIpassword != "" {
+		config.CIpassword = "<redacted>"
+	}
+	if config.Sshkeys != "" {
+		config.Sshkeys = "<redacted>"
+	}
+	return configQemuPrint(config)
+}
+
+// String - the config for logs (%v, %+v), with cipassword and sshkeys redacted
+func (config ConfigQemu) String() string {
+	return fmt.Sprintf("%+v", config.redacted())
+}
+
+// GoString - %#v of the config, with cipassword and sshkeys redacted
+func (config ConfigQemu) GoString() string {
+	return strings.Replace(fmt.Sprintf("%#v", config.redacted()), "configQemuPrint", "ConfigQemu", 1)
+}
+
+// QemuIpConfig - cloud-init address of one nic, the value of Ipconfig0/Ipconfig1.
+// IP is an address with prefix (10.0.0.5/24) or dhcp, IP6 also takes auto (SLAAC).
+// Leave IP or IP6 empty for an IPv6-only or IPv4-only guest.
+type QemuIpConfig struct {
+	IP       string
+	Gateway  string
+	IP6      string
+	Gateway6 string
+}
+
+// ParseQemuIpConfig - read an ipconfigN value like ip=10.0.0.5/24,gw=10.0.0.1,ip6=auto
+func ParseQemuIpConfig(ipconfig string) (ipConfig QemuIpConfig, err error) {
+	for _, option := range strings.Split(ipconfig, ",") {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return ipConfig, fmt.Errorf("invalid ipconfig '%s', expected key=value options", ipconfig)
+		}
+		switch keyValue[0] {
+		case "ip":
+			ipConfig.IP = keyValue[1]
+		case "gw":
+			ipConfig.Gateway = keyValue[1]
+		case "ip6":
+			ipConfig.IP6 = keyValue[1]
+		case "gw6":
+			ipConfig.Gateway6 = keyValue[1]
+		default:
+			return ipConfig, fmt.Errorf("invalid ipconfig '%s', unknown option %s", ipconfig, keyValue[0])
+		}
+	}
+	return ipConfig, ipConfig.Validate()
+}
+
+// Validate - check the addresses: ip is dhcp or an IPv4 prefix, ip6 dhcp, auto or an IPv6 prefix,
+// the gateways plain addresses of their family, only set with a static address.
+func (ipConfig QemuIpConfig) Validate() error {
+	if ipConfig.IP != "" && ipConfig.IP != "dhcp" {
+		if ip, _, err := net.ParseCIDR(ipConfig.IP); err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid ip '%s', expected dhcp or an IPv4 address with prefix like 10.0.0.5/24", ipConfig.IP)
+		}
+	}
+	if ipConfig.Gateway != "" {
+		if ip := net.ParseIP(ipConfig.Gateway); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("invalid gw '%s', expected an IPv4 address", ipConfig.Gateway)
+		}
+		if ipConfig.IP == "" || ipConfig.IP == "dhcp" {
+			return fmt.Errorf("gw %s needs a static ip", ipConfig.Gateway)
+		}
+	}
+	if ipConfig.IP6 != "" && ipConfig.IP6 != "dhcp" && ipConfig.IP6 != "auto" {
+		if ip, _, err := net.ParseCIDR(ipConfig.IP6); err != nil || ip.To4() != nil {
+			return fmt.Errorf("invalid ip6 '%s', expected dhcp, auto or an IPv6 address with prefix like 2001:db8::5/64", ipConfig.IP6)
+		}
+	}
+	if ipConfig.Gateway6 != "" {
+		if ip := net.ParseIP(ipConfig.Gateway6); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("invalid gw6 '%s', expected an IPv6 address", ipConfig.Gateway6)
+		}
+		if ipConfig.IP6 == "" || ipConfig.IP6 == "dhcp" || ipConfig.IP6 == "auto" {
+			return fmt.Errorf("gw6 %s needs a static ip6", ipConfig.Gateway6)
+		}
+	}
+	return nil
+}
+
+// String - the ipconfigN value Proxmox takes
+func (ipConfig QemuIpConfig) String() string {
+	options := []string{}
+	if ipConfig.IP != "" {
+		options = append(options, "ip="+ipConfig.IP)
+	}
+	if ipConfig.Gateway != "" {
+		options = append(options, "gw="+ipConfig.Gateway)
+	}
+	if ipConfig.IP6 != "" {
+		options = append(options, "ip6="+ipConfig.IP6)
+	}
+	if ipConfig.Gateway6 != "" {
+		options = append(options, "gw6="+ipConfig.Gateway6)
+	}
+	return strings.Join(options, ",")
+}
+
+/*
+CloneVm
+Example: Request
+
+nodes/proxmox1-xx/qemu/1012/clone
+
+newid:145
+name:tf-clone1
+target:proxmox1-xx
+full:1
+storage:xxx
+
+The source node goes in the path and vmr's node is the target,
+they differ when cloning to another cluster node.
+*/
+func (config ConfigQemu) CloneVm(sourceVmr *VmRef, vmr *VmRef, client *Client) (err error) {
+	if err = vmr.checkNode(); err != nil {
+		return
+	}
+	if err = config.Validate(); err != nil {
+		return
+	}
+	// Look up the source node when the caller only knows the vmid.
+	if err = client.CheckVmRef(sourceVmr); err != nil {
+		return
+	}
+	if sourceVmr.vmType != "qemu" {
+		return fmt.Errorf("clone source %d is a %s, not a qemu vm", sourceVmr.vmId, sourceVmr.vmType)
+	}
+	if sourceVmr.vmId == vmr.vmId {
+		return fmt.Errorf("clone target vmid %d is the source vmid", vmr.vmId)
+	}
+	vmr.SetVmType("qemu")
+	params := map[string]interface{}{
+		"newid":  vmr.vmId,
+		"target": vmr.node,
+		"name":   config.Name,
+		"full":   Btoi(config.GetCloneType() == CloneFull),
+	}
+	// Linked clones stay on the storage of the template.
+	if config.GetCloneType() == CloneFull {
+		params["storage"] = config.Storage
+	}
+	_, err = client.CloneQemuVm(sourceVmr, params)
+	if err != nil {
+		return
+	}
+
+	// The clone already has the template's devices: disks it has are updated in place
+	// (pointed at the cloned volumes), only the disks it lacks get allocated.
+	// Networks are replaced by their netN slot.
+	cloned, err := NewConfigQemuFromApi(vmr, client)
+	if err != nil {
+		return
+	}
+	existingDisks, newDisks := config.QemuDisks.splitExisting(cloned.QemuDisks, config.defaultDiskType())
+	// Clone puts all disks on one storage, the ones wanted elsewhere are moved after the update,
+	// converting them to their format.
+	moves := QemuDevices{}
+	for diskID, disk := range existingDisks {
+		storage, _ := config.QemuDisks[diskID]["storage"].(string)
+		if storage != "" && storage != disk["storage"] {
+			moves[diskID] = QemuDevice{"storage": storage, "format": disk["format"]}
+			delete(disk, "format")
+		}
+	}
+	config.QemuDisks = existingDisks
+	if config.RegenerateVmGenId && config.VmGenId == "" {
+		if config.VmGenId, err = GenerateVmGenId(); err != nil {
+			return
+		}
+	}
+	configParams, err := config.BuildUpdateParams(vmr)
+	if err != nil {
+		return
+	}
+	newDisksConfig := ConfigQemu{QemuOs: config.QemuOs, QemuDisks: newDisks}
+	if err = newDisksConfig.CreateQemuDisksParams(vmr.vmId, "create", configParams); err != nil {
+		return
+	}
+	if config.RegenerateMacs {
+		// NICs only the template has would keep its MACs.
+		templateNics := QemuDevices{}
+		for nicID, nic := range cloned.QemuNetworks {
+			if _, isSet := config.QemuNetworks[nicID]; !isSet {
+				templateNics[nicID] = nic
+			}
+		}
+		templateNicsConfig := ConfigQemu{QemuOs: config.QemuOs, QemuNetworks: templateNics, RegenerateMacs: true}
+		if err = templateNicsConfig.CreateQemuNetworksParams(vmr.vmId, configParams); err != nil {
+			return
+		}
+	}
+	_, err = client.SetVmConfig(vmr, configParams)
+	if err != nil {
+		return
+	}
+
+	for _, diskID := range moves.ids() {
+		disk := fmt.Sprintf("%v%d", existingDisks[diskID]["type"], diskID)
+		format, _ := moves[diskID]["format"].(string)
+		if _, err = client.MoveQemuDisk(vmr, disk, moves[diskID]["storage"].(string), format, true); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// GetCloneType - CloneFull unless FullClone is explicitly 0
+func (config ConfigQemu) GetCloneType() CloneType {
+	if config.FullClone != nil && *config.FullClone == 0 {
+		return CloneLinked
+	}
+	return CloneFull
+}
+
+// SetCloneType - set FullClone from a CloneType
+func (config *ConfigQemu) SetCloneType(cloneType CloneType) {
+	fullclone := 1
+	if cloneType == CloneLinked {
+		fullclone = 0
+	}
+	config.FullClone = &fullclone
+}
+
+// ReadBackQemuDisks - QemuDisks with the volumes Proxmox assigned on create,
+// "storage" and "file" are read from the VM config. Call it after CreateVm,
+// so following updates reference the real volumes instead of guessed names.
+func (config ConfigQemu) ReadBackQemuDisks(vmr *VmRef, client *Client) (disks QemuDevices, err error) {
+	current, err := NewConfigQemuFromApi(vmr, client)
+	if err != nil {
+		return nil, err
+	}
+	disks, missing := config.QemuDisks.splitExisting(current.QemuDisks, config.defaultDiskType())
+	for diskID, diskConfMap := range missing {
+		return nil, fmt.Errorf("disk %v%d not found on vm %d", diskConfMap["type"], diskID, vmr.vmId)
+	}
+	return disks, nil
+}
+
+// CloneAndResize - CloneVm, then grow disk (e.g. scsi0) of the clone to newSizeGB,
+// the usual way to get a bigger root disk than the template's.
+func (config ConfigQemu) CloneAndResize(sourceVmr *VmRef, vmr *VmRef, client *Client, disk string, newSizeGB int) (*VmRef, error) {
+	if err := config.CloneVm(sourceVmr, vmr, client); err != nil {
+		return nil, err
+	}
+	// Waits out a clone lock still held, a locked VM can't be resized.
+	if _, err := NewConfigQemuFromApi(vmr, client); err != nil {
+		return nil, err
+	}
+	if err := client.growQemuDisk(vmr, disk, newSizeGB); err != nil {
+		return nil, err
+	}
+	return vmr, nil
+}
+
+// Split disks into the ones present in current, pointed at the current volume,
+// and the ones that don't exist yet. Disks without a type are on defaultType, see defaultDiskType.
+func (devices QemuDevices) splitExisting(current QemuDevices, defaultType string) (existing QemuDevices, missing QemuDevices) {
+	existing, missing = QemuDevices{}, QemuDevices{}
+	for id, device := range devices {
+		deviceType := device["type"]
+		if deviceType == nil || deviceType == "" {
+			deviceType = defaultType
+		}
+		currentDevice, isSet := current[id]
+		if !isSet || currentDevice["type"] != deviceType {
+			missing[id] = device
+			continue
+		}
+		existingDevice := QemuDevice(device).copy()
+		existingDevice["type"] = deviceType
+		existingDevice["storage"] = currentDevice["storage"]
+		existingDevice["file"] = currentDevice["file"]
+		existing[id] = existingDevice
+	}
+	return
+}
+
+// Check the storages used are enabled for what goes on them: images for disks, iso for QemuIso.
+// Proxmox rejects them as well, but with a less telling message.
+func (config ConfigQemu) checkStorageContent(node string, client *Client) error {
+	needed := map[string]string{}
+	for _, disk := range config.QemuDisks {
+		if storage, _ := disk["storage"].(string); storage != "" {
+			needed[storage] = "images"
+		}
+	}
+	if len(config.QemuDisks) == 0 && config.Storage != "" {
+		needed[config.Storage] = "images"
+	}
+	if isoStorage := strings.SplitN(config.QemuIso, ":", 2); len(isoStorage) == 2 {
+		if _, isDiskStorage := needed[isoStorage[0]]; isDiskStorage {
+			needed[isoStorage[0]] += ",iso"
+		} else {
+			needed[isoStorage[0]] = "iso"
+		}
+	}
+	for storage, contentTypes := range needed {
+		content, err := client.GetStorageContent(node, storage)
+		if err != nil {
+			return err
+		}
+		for _, contentType := range strings.Split(contentTypes, ",") {
+			if !inArray(content, contentType) {
+				return fmt.Errorf("storage %s doesn't hold %s (content: %s), enable it or use another storage",
+					storage, contentType, strings.Join(content, ","))
+			}
+		}
+	}
+	return nil
+}
+
+// A copy of the disks with storage_type looked up on node where it's missing,
+// the disk format defaults and volume naming depend on it.
+func (devices QemuDevices) withStorageTypes(node string, client *Client) (QemuDevices, error) {
+	disks := devices.copy()
+	storageTypes := map[string]string{}
+	for _, disk := range disks {
+		storage, _ := disk["storage"].(string)
+		if storageType, _ := disk["storage_type"].(string); storageType != "" || storage == "" {
+			continue
+		}
+		if _, isKnown := storageTypes[storage]; !isKnown {
+			storageType, err := client.GetStorageType(node, storage)
+			if err != nil {
+				return nil, err
+			}
+			storageTypes[storage] = storageType
+		}
+		disk["storage_type"] = storageTypes[storage]
+	}
+	return disks, nil
+}
+
+// Device ids in ascending order, so params are built in the same order every time.
+func (devices QemuDevices) ids() []int {
+	ids := make([]int, 0, len(devices))
+	for id := range devices {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+func (devices QemuDevices) copy() QemuDevices {
+	if devices == nil {
+		return nil
+	}
+	devicesCopy := QemuDevices{}
+	for id, device := range devices {
+		devicesCopy[id] = QemuDevice(device).copy()
+	}
+	return devicesCopy
+}
+
+// Clone - a copy of the config that shares no maps, slices or pointers with it,
+// so changes to the copy (including generated MACs) don't leak into config.
+func (config ConfigQemu) Clone() ConfigQemu {
+	clone := config
+	if config.Reboot != nil {
+		reboot := *config.Reboot
+		clone.Reboot = &reboot
+	}
+	if config.Autostart != nil {
+		autostart := *config.Autostart
+		clone.Autostart = &autostart
+	}
+	if config.Protection != nil {
+		protection := *config.Protection
+		clone.Protection = &protection
+	}
+	if config.FullClone != nil {
+		fullClone := *config.FullClone
+		clone.FullClone = &fullClone
+	}
+	if config.QemuCpuFlags != nil {
+		clone.QemuCpuFlags = append([]string{}, config.QemuCpuFlags...)
+	}
+	if config.BootOrder != nil {
+		clone.BootOrder = append([]string{}, config.BootOrder...)
+	}
+	clone.QemuDisks = config.QemuDisks.copy()
+	clone.QemuNetworks = config.QemuNetworks.copy()
+	clone.QemuPCIDevices = config.QemuPCIDevices.copy()
+	clone.QemuUnusedDisks = config.QemuUnusedDisks.copy()
+	if config.ExtraConfig != nil {
+		clone.ExtraConfig = make(map[string]interface{}, len(config.ExtraConfig))
+		for key, value := range config.ExtraConfig {
+			clone.ExtraConfig[key] = value
+		}
+	}
+	return clone
+}
+
+// EnsureVm - CreateVm when vmr doesn't exist yet, otherwise UpdateConfig to bring it in line
+// with config. created tells which one happened.
+func (config ConfigQemu) EnsureVm(vmr *VmRef, client *Client) (created bool, err error) {
+	exists, err := client.VmExists(vmr.vmId)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return true, config.CreateVm(vmr, client)
+	}
+	// The VM may live on another node than the one given for creating it.
+	vmr.node = ""
+	if err = client.CheckVmRef(vmr); err != nil {
+		return false, err
+	}
+	if vmr.vmType != "qemu" {
+		return false, fmt.Errorf("vm %d is a %s, not a qemu vm", vmr.vmId, vmr.vmType)
+	}
+	return false, config.UpdateConfig(vmr, client)
+}
+
+// UpdateConfig - send the options that differ from the VM's current config, see Diff
+func (config ConfigQemu) UpdateConfig(vmr *VmRef, client *Client) (err error) {
+	_, err = config.UpdateConfigPending(vmr, client)
+	return err
+}
+
+// UpdateConfigPending - UpdateConfig, returning the keys Proxmox staged as pending
+// because they can't be applied to the running VM (e.g. bios, machine, cpu type).
+// Those changes only take effect after the VM is restarted.
+func (config ConfigQemu) UpdateConfigPending(vmr *VmRef, client *Client) (rebootKeys []string, err error) {
+	if err = vmr.checkNode(); err != nil {
+		return
+	}
+	vmr.SetVmType("qemu")
+	if config.QemuDisks, err = config.QemuDisks.withStorageTypes(vmr.node, client); err != nil {
+		return
+	}
+	// Only send what changed, resending unchanged disks and nics churns the VM.
+	current, err := NewConfigQemuFromApi(vmr, client)
+	if err != nil {
+		return
+	}
+	configParams, err := config.Diff(vmr, *current)
+	if err != nil {
+		return
 	}
 
-	// Create disks config.
-	config.CreateQemuDisksParams(vmr.vmId, "create", params)
-
-	// Create networks config.
-	config.CreateQemuNetworksParams(vmr.vmId, params)
+	if len(configParams) > 0 {
+		_, err = client.SetVmConfig(vmr, configParams)
+		if err != nil {
+			return
+		}
+	}
 
-	_, err = client.CreateQemuVm(vmr.node, params)
+	vmPending, err := client.GetVmPendingConfig(vmr)
+	if err != nil {
+		return
+	}
+	rebootKeys = []string{}
+	for _, entry := range vmPending {
+		item := entry.(map[string]interface{})
+		if item["pending"] != nil || item["delete"] != nil {
+			rebootKeys = append(rebootKeys, item["key"].(string))
+		}
+	}
+	sort.Strings(rebootKeys)
 	return
 }
 
-// HasCloudInit - are there cloud-init options?
-func (config ConfigQemu) HasCloudInit() bool {
-	return config.CIuser != "" ||
-		config.CIpassword != "" ||
-		config.Searchdomain != "" ||
-		config.Nameserver != "" ||
-		config.Sshkeys != "" ||
-		config.Ipconfig0 != "" ||
-		config.Ipconfig1 != ""
+// BuildUpdateParams - the params UpdateConfig sends to Proxmox, without calling the API
+func (config ConfigQemu) BuildUpdateParams(vmr *VmRef) (configParams map[string]interface{}, err error) {
+	if err = config.Validate(); err != nil {
+		return nil, err
+	}
+	return config.updateParams(vmr)
 }
 
-/*
-
-CloneVm
-Example: Request
-
-nodes/proxmox1-xx/qemu/1012/clone
+// BuildUpdateParams without Validate, also used on configs read from the API.
+func (config ConfigQemu) updateParams(vmr *VmRef) (configParams map[string]interface{}, err error) {
+	configParams = map[string]interface{}{
+		"onboot": Btoi(config.Onboot),
+		"agent":  config.Agent,
+	}
+	if config.Description != "" {
+		configParams["description"] = config.Description
+	}
+	// 0 isn't a valid size, it leaves sockets, cores and memory as they are.
+	if config.QemuSockets > 0 {
+		configParams["sockets"] = config.QemuSockets
+	}
+	if config.QemuCores > 0 {
+		configParams["cores"] = config.QemuCores
+	}
+	if config.Memory > 0 {
+		configParams["memory"] = config.Memory
+	}
+	if config.Affinity != "" {
+		configParams["affinity"] = config.Affinity
+	}
+	if config.Reboot != nil {
+		configParams["reboot"] = Btoi(*config.Reboot)
+	}
+	if config.Autostart != nil {
+		configParams["autostart"] = Btoi(*config.Autostart)
+	}
+	if config.Protection != nil {
+		configParams["protection"] = Btoi(*config.Protection)
+	}
+	if config.VmGenId != "" {
+		configParams["vmgenid"] = config.VmGenId
+	}
+	if config.Args != "" {
+		configParams["args"] = config.Args
+	}
+	if config.HookScript != "" {
+		configParams["hookscript"] = config.HookScript
+	}
+	if config.Hotplug != "" {
+		configParams["hotplug"] = config.Hotplug
+	}
+	if config.Startup != "" {
+		configParams["startup"] = config.Startup
+	}
+	if config.Scsihw != "" {
+		configParams["scsihw"] = config.Scsihw
+	}
+	if len(config.BootOrder) > 0 {
+		configParams["boot"] = config.bootParam()
+	}
+	if config.QemuCpu != "" || len(config.QemuCpuFlags) > 0 {
+		configParams["cpu"] = config.cpuParam()
+	}
 
-newid:145
-name:tf-clone1
-target:proxmox1-xx
-full:1
-storage:xxx
+	config.cloudInitParams(configParams)
 
-*/
-func (config ConfigQemu) CloneVm(sourceVmr *VmRef, vmr *VmRef, client *Client) (err error) {
-	vmr.SetVmType("qemu")
-	fullclone := "1"
-	if config.FullClone != nil {
-		fullclone = strconv.Itoa(*config.FullClone)
+	// Create disks config.
+	if err = config.CreateQemuDisksParams(vmr.vmId, "update", configParams); err != nil {
+		return nil, err
 	}
-	params := map[string]interface{}{
-		"newid":   vmr.vmId,
-		"target":  vmr.node,
-		"name":    config.Name,
-		"storage": config.Storage,
-		"full":    fullclone,
+
+	// Create networks config.
+	if err = config.CreateQemuNetworksParams(vmr.vmId, configParams); err != nil {
+		return nil, err
 	}
-	_, err = client.CloneQemuVm(sourceVmr, params)
-	if err != nil {
-		return
+
+	// Create PCI devices config.
+	if err = config.CreateQemuPCIsParams(configParams); err != nil {
+		return nil, err
 	}
-	return config.UpdateConfig(vmr, client)
-}
 
-func (config ConfigQemu) UpdateConfig(vmr *VmRef, client *Client) (err error) {
-	configParams := map[string]interface{}{
-		"description": config.Description,
-		"onboot":      config.Onboot,
-		"sockets":     config.QemuSockets,
-		"cores":       config.QemuCores,
-		"memory":      config.Memory,
+	for key, value := range config.ExtraConfig {
+		configParams[key] = value
 	}
+	return
+}
 
-	// cloud-init options
+// Set the cloud-init options in params.
+func (config ConfigQemu) cloudInitParams(params map[string]interface{}) {
 	if config.CIuser != "" {
-		configParams["ciuser"] = config.CIuser
+		params["ciuser"] = config.CIuser
 	}
 	if config.CIpassword != "" {
-		configParams["cipassword"] = config.CIpassword
+		params["cipassword"] = config.CIpassword
 	}
 	if config.Searchdomain != "" {
-		configParams["searchdomain"] = config.Searchdomain
+		params["searchdomain"] = config.Searchdomain
 	}
 	if config.Nameserver != "" {
-		configParams["nameserver"] = config.Nameserver
+		params["nameserver"] = config.Nameserver
 	}
 	if config.Sshkeys != "" {
 		sshkeyEnc := url.PathEscape(config.Sshkeys + "\n")
 		sshkeyEnc = strings.Replace(sshkeyEnc, "+", "%2B", -1)
 		sshkeyEnc = strings.Replace(sshkeyEnc, "@", "%40", -1)
 		sshkeyEnc = strings.Replace(sshkeyEnc, "=", "%3D", -1)
-		configParams["sshkeys"] = sshkeyEnc
+		params["sshkeys"] = sshkeyEnc
 	}
 	if config.Ipconfig0 != "" {
-		configParams["ipconfig0"] = config.Ipconfig0
+		params["ipconfig0"] = config.Ipconfig0
 	}
 	if config.Ipconfig1 != "" {
-		configParams["ipconfig1"] = config.Ipconfig1
+		params["ipconfig1"] = config.Ipconfig1
 	}
-	// Create disks config.
-	config.CreateQemuDisksParams(vmr.vmId, "update", configParams)
+}
 
-	// Create networks config.
-	config.CreateQemuNetworksParams(vmr.vmId, configParams)
+// Diff - the update params that change the VM from current (e.g. NewConfigQemuFromApi) to desired.
+// Disks and nics are compared as a whole device, missing MACs and volumes are taken from current,
+// disks current lacks are created. Disks and nics missing from desired are deleted, Proxmox keeps
+// the volume of a deleted disk as unusedN. Options desired leaves empty are deleted as well, back to
+// their Proxmox default, except for what diffKeptOptions lists and the raw ExtraConfig keys of current.
+// It takes vmr for the vmid new disk volumes and generated MACs are named after, and returns
+// the Validate error of desired, so it isn't a plain Diff(current) map.
+func (desired ConfigQemu) Diff(vmr *VmRef, current ConfigQemu) (changes map[string]interface{}, err error) {
+	if err = desired.Validate(); err != nil {
+		return nil, err
+	}
+	existingDisks, newDisks := desired.QemuDisks.splitExisting(current.QemuDisks, desired.defaultDiskType())
+	for _, disk := range existingDisks {
+		if sizeGB, err := diskSizeGB(disk["size"]); err == nil {
+			disk["size"] = strconv.FormatFloat(sizeGB, 'f', -1, 64) + "G"
+		}
+	}
+	desired.QemuDisks = existingDisks
+	networks := QemuDevices{}
+	for nicID, nic := range desired.QemuNetworks {
+		currentNic, isSet := current.QemuNetworks[nicID]
+		if macaddr, _ := nic["macaddr"].(string); isSet && macaddr == "" {
+			nic = QemuDevice(nic).copy()
+			nic["macaddr"] = currentNic["macaddr"]
+		}
+		// New nics keep the map, for the documented MAC write-back.
+		networks[nicID] = nic
+	}
+	desired.QemuNetworks = networks
 
-	_, err = client.SetVmConfig(vmr, configParams)
-	return err
+	desiredParams, err := desired.updateParams(vmr)
+	if err != nil {
+		return nil, err
+	}
+	newDisksConfig := ConfigQemu{QemuOs: desired.QemuOs, QemuDisks: newDisks}
+	if err = newDisksConfig.CreateQemuDisksParams(vmr.vmId, "create", desiredParams); err != nil {
+		return nil, err
+	}
+	currentParams, err := current.updateParams(vmr)
+	if err != nil {
+		return nil, err
+	}
+
+	changes = map[string]interface{}{}
+	for key, value := range desiredParams {
+		if currentValue, isSet := currentParams[key]; !isSet || fmt.Sprintf("%v", currentValue) != fmt.Sprintf("%v", value) {
+			changes[key] = value
+		}
+	}
+	deletes := []string{}
+	for key := range currentParams {
+		if _, isSet := desiredParams[key]; isSet || inArray(diffKeptOptions, key) {
+			continue
+		}
+		if _, isExtra := current.ExtraConfig[key]; isExtra {
+			continue
+		}
+		deletes = append(deletes, key)
+	}
+	if len(deletes) > 0 {
+		sort.Strings(deletes)
+		changes["delete"] = strings.Join(deletes, ",")
+	}
+	return
 }
 
+// Options Diff keeps when desired leaves them empty: 0 is no size, nil *bool means unset
+// and vmgenid is an identity better not reset by accident.
+var diffKeptOptions = []string{"sockets", "cores", "memory", "reboot", "autostart", "protection", "vmgenid"}
+
 func NewConfigQemuFromJson(io io.Reader) (config *ConfigQemu, err error) {
 	config = &ConfigQemu{QemuVlanTag: -1}
 	err = json.NewDecoder(io).Decode(config)
 	if err != nil {
-		log.Fatal(err)
 		return nil, err
 	}
-	log.Println(config)
 	return
 }
 
 var (
-	rxIso      = regexp.MustCompile(`(.*?),media`)
-	rxDeviceID = regexp.MustCompile(`\d+`)
-	rxDiskName = regexp.MustCompile(`virtio\d+`)
-	rxDiskType = regexp.MustCompile(`\D+`)
-	rxNicName  = regexp.MustCompile(`net\d+`)
+	rxDeviceID       = regexp.MustCompile(`\d+`)
+	rxDiskName       = regexp.MustCompile(`^(ide|sata|scsi|virtio)\d+$`)
+	rxDiskType       = regexp.MustCompile(`\D+`)
+	rxNicName        = regexp.MustCompile(`net\d+`)
+	rxUnusedDiskName = regexp.MustCompile(`unused\d+`)
+	rxPCIName        = regexp.MustCompile(`hostpci\d+`)
 )
 
+// Locks held while a VM is being set up, the config is incomplete until they are released.
+var qemuTemporaryLocks = []string{"clone", "create"}
+
+// ConfigLockRetries - how often NewConfigQemuFromApi reads a locked config before giving up
+var ConfigLockRetries = 3
+
+// ConfigLockRetryInterval - seconds between reads of a locked config
+var ConfigLockRetryInterval = 8
+
 func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err error) {
-	var vmConfig map[string]interface{}
-	for ii := 0; ii < 3; ii++ {
+	config, _, err = NewConfigQemuFromApiRaw(vmr, client)
+	return
+}
+
+// NewConfigQemuFromApiRaw - NewConfigQemuFromApi, also returning (a copy of) the
+// config map Proxmox sent, with the keys and formatting the typed config drops.
+func NewConfigQemuFromApiRaw(vmr *VmRef, client *Client) (config *ConfigQemu, vmConfig map[string]interface{}, err error) {
+	for ii := 0; ii < ConfigLockRetries; ii++ {
+		// Transient errors are already retried by the client.
 		vmConfig, err = client.GetVmConfig(vmr)
 		if err != nil {
-			log.Fatal(err)
-			return nil, err
+			return nil, nil, err
 		}
 		// this can happen:
 		// {"data":{"lock":"clone","digest":"eb54fb9d9f120ba0c3bdf694f73b10002c375c38","description":" qmclone temporary file\n"}})
-		if vmConfig["lock"] == nil {
+		// Other locks (backup, migrate, ...) can last long, they are reported in config.Lock.
+		if !inArray(qemuTemporaryLocks, fmt.Sprintf("%v", vmConfig["lock"])) {
 			break
-		} else {
-			time.Sleep(8 * time.Second)
+		} else if ii < ConfigLockRetries-1 {
+			vmr.InvalidateConfigCache()
+			time.Sleep(time.Duration(ConfigLockRetryInterval) * time.Second)
 		}
 	}
 
-	if vmConfig["lock"] != nil {
-		return nil, errors.New("vm locked, could not obtain config")
+	if inArray(qemuTemporaryLocks, fmt.Sprintf("%v", vmConfig["lock"])) {
+		return nil, nil, fmt.Errorf("vm locked (%v), could not obtain config", vmConfig["lock"])
+	}
+
+	config, err = newConfigQemuFromVmConfig(vmConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The map may be the VmRef's config cache.
+	rawConfig := make(map[string]interface{}, len(vmConfig))
+	for key, value := range vmConfig {
+		rawConfig[key] = value
+	}
+	return config, rawConfig, nil
+}
+
+// NewConfigQemuFromApiPending - like NewConfigQemuFromApi, but with staged
+// changes that only apply on the next VM start (e.g. memory/cpu without hotplug).
+func NewConfigQemuFromApiPending(vmr *VmRef, client *Client) (config *ConfigQemu, err error) {
+	vmPending, err := client.GetVmPendingConfig(vmr)
+	if err != nil {
+		return nil, err
+	}
+	return newConfigQemuFromVmConfig(pendingToVmConfig(vmPending))
+}
+
+// Merge the pending entries into a regular config map, as it will look after a restart.
+func pendingToVmConfig(vmPending []interface{}) (vmConfig map[string]interface{}) {
+	vmConfig = map[string]interface{}{}
+	for _, entry := range vmPending {
+		item := entry.(map[string]interface{})
+		key := item["key"].(string)
+		if item["delete"] != nil {
+			continue
+		}
+		if pending, isSet := item["pending"]; isSet {
+			vmConfig[key] = pending
+		} else if value, isSet := item["value"]; isSet {
+			vmConfig[key] = value
+		}
 	}
+	return
+}
 
+func newConfigQemuFromVmConfig(vmConfig map[string]interface{}) (config *ConfigQemu, err error) {
 	// vmConfig Sample: map[ cpu:host
 	// net0:virtio=62:DF:XX:XX:XX:XX,bridge=vmbr0
 	// ide2:local:iso/xxx-xx.iso,media=cdrom memory:2048
@@ -219,10 +1344,6 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 	// description:Base image
 	// cores:2 ostype:l26
 
-	fullclone := 1
-	if vmConfig["fullclone"] != nil {
-		fullclone = int(vmConfig["fullclone"].(float64))
-	}
 	name := ""
 	if _, isSet := vmConfig["name"]; isSet {
 		name = vmConfig["name"].(string)
@@ -235,35 +1356,111 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 	if _, isSet := vmConfig["ostype"]; isSet {
 		ostype = vmConfig["ostype"].(string)
 	}
-	memory := 0.0
-	if _, isSet := vmConfig["memory"]; isSet {
-		memory = vmConfig["memory"].(float64)
+	memory, err := vmConfigInt(vmConfig, "memory", 0)
+	if err != nil {
+		return nil, err
+	}
+	cores, err := vmConfigInt(vmConfig, "cores", 1)
+	if err != nil {
+		return nil, err
+	}
+	sockets, err := vmConfigInt(vmConfig, "sockets", 1)
+	if err != nil {
+		return nil, err
 	}
-	cores := 1.0
-	if _, isSet := vmConfig["cores"]; isSet {
-		cores = vmConfig["cores"].(float64)
+	onboot, err := vmConfigInt(vmConfig, "onboot", 0)
+	if err != nil {
+		return nil, err
 	}
-	sockets := 1.0
-	if _, isSet := vmConfig["sockets"]; isSet {
-		sockets = vmConfig["sockets"].(float64)
+	lock := ""
+	if _, isSet := vmConfig["lock"]; isSet {
+		lock = vmConfig["lock"].(string)
 	}
 	config = &ConfigQemu{
-		Name:         name,
-		Onboot:       Itob(int(vmConfig["onboot"].(float64))),
-		Description:  strings.TrimSpace(description),
-		QemuOs:       ostype,
-		Memory:       int(memory),
-		QemuCores:    int(cores),
-		QemuSockets:  int(sockets),
-		QemuVlanTag:  -1,
-		FullClone:    &fullclone,
-		QemuDisks:    QemuDevices{},
-		QemuNetworks: QemuDevices{},
+		Name:            name,
+		Onboot:          Itob(onboot),
+		Lock:            lock,
+		Description:     strings.TrimSpace(description),
+		QemuOs:          ostype,
+		Memory:          memory,
+		QemuCores:       cores,
+		QemuSockets:     sockets,
+		QemuVlanTag:     -1,
+		QemuDisks:       QemuDevices{},
+		QemuNetworks:    QemuDevices{},
+		QemuUnusedDisks: QemuDevices{},
+		QemuPCIDevices:  QemuDevices{},
 	}
 
-	if vmConfig["ide2"] != nil {
-		isoMatch := rxIso.FindStringSubmatch(vmConfig["ide2"].(string))
-		config.QemuIso = isoMatch[1]
+	if _, isSet := vmConfig["autostart"]; isSet {
+		autostart, err := vmConfigInt(vmConfig, "autostart", 0)
+		if err != nil {
+			return nil, err
+		}
+		autostartBool := Itob(autostart)
+		config.Autostart = &autostartBool
+	}
+	if _, isSet := vmConfig["protection"]; isSet {
+		protection, err := vmConfigInt(vmConfig, "protection", 0)
+		if err != nil {
+			return nil, err
+		}
+		protectionBool := Itob(protection)
+		config.Protection = &protectionBool
+	}
+	if meta, isSet := vmConfig["meta"].(string); isSet {
+		config.Meta = meta
+	}
+	if _, isSet := vmConfig["affinity"]; isSet {
+		config.Affinity = vmConfig["affinity"].(string)
+	}
+	if _, isSet := vmConfig["cpu"]; isSet {
+		// [cputype=]<type>[,flags=<+flag;-flag...>]
+		cpuConfList := strings.Split(vmConfig["cpu"].(string), ",")
+		for _, cpuConf := range cpuConfList {
+			switch conf := strings.SplitN(cpuConf, "=", 2); {
+			case len(conf) == 1:
+				config.QemuCpu = conf[0]
+			case conf[0] == "cputype":
+				config.QemuCpu = conf[1]
+			case conf[0] == "flags":
+				config.QemuCpuFlags = strings.Split(conf[1], ";")
+			}
+		}
+	}
+	if _, isSet := vmConfig["agent"]; isSet {
+		// [enabled=]<1|0>[,fstrim_cloned_disks=<1|0>][,type=<virtio|isa>]
+		agentConf := strings.TrimPrefix(strings.Split(fmt.Sprintf("%v", vmConfig["agent"]), ",")[0], "enabled=")
+		if config.Agent, err = toInt(agentConf); err != nil {
+			return nil, fmt.Errorf("agent: %v", err)
+		}
+	}
+	if _, isSet := vmConfig["vmgenid"]; isSet {
+		config.VmGenId = vmConfig["vmgenid"].(string)
+	}
+	if _, isSet := vmConfig["args"]; isSet {
+		config.Args = vmConfig["args"].(string)
+	}
+	if _, isSet := vmConfig["hookscript"]; isSet {
+		config.HookScript = vmConfig["hookscript"].(string)
+	}
+	if _, isSet := vmConfig["hotplug"]; isSet {
+		config.Hotplug = fmt.Sprintf("%v", vmConfig["hotplug"])
+	}
+	if _, isSet := vmConfig["startup"]; isSet {
+		config.Startup = vmConfig["startup"].(string)
+	}
+	config.BootOrder = parseBootOrder(vmConfig)
+	if _, isSet := vmConfig["scsihw"]; isSet {
+		config.Scsihw = vmConfig["scsihw"].(string)
+	}
+	if _, isSet := vmConfig["reboot"]; isSet {
+		rebootInt, err := vmConfigInt(vmConfig, "reboot", 1)
+		if err != nil {
+			return nil, err
+		}
+		reboot := Itob(rebootInt)
+		config.Reboot = &reboot
 	}
 
 	// Disks.
@@ -274,26 +1471,46 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 			diskNames = append(diskNames, diskName[0])
 		}
 	}
+	// QemuDisks is keyed by index only: of scsi0 and virtio0 the first in name order is read,
+	// the other stays in ExtraConfig.
+	sort.Strings(diskNames)
 
 	for _, diskName := range diskNames {
 		diskConfStr := vmConfig[diskName]
 		diskConfList := strings.Split(diskConfStr.(string), ",")
 
+		// CD-ROM drives aren't disks. The one on ide2, where CreateVm puts it, is QemuIso
+		// (none when empty), any other drive stays in ExtraConfig. So does the cloud-init drive,
+		// Proxmox reports it as a cdrom too.
+		if inArray(diskConfList[1:], "media=cdrom") {
+			if diskName == "ide2" && diskConfList[0] != "none" && !strings.Contains(diskConfList[0], "cloudinit") {
+				config.QemuIso = diskConfList[0]
+			}
+			continue
+		}
+
 		//
 		id := rxDeviceID.FindStringSubmatch(diskName)
 		diskID, _ := strconv.Atoi(id[0])
 		diskType := rxDiskType.FindStringSubmatch(diskName)[0]
-		diskStorageAndFile := strings.Split(diskConfList[0], ":")
+		if _, isSet := config.QemuDisks[diskID]; isSet {
+			continue
+		}
 
-		//
-		diskConfMap := QemuDevice{
-			"type":    diskType,
-			"storage": diskStorageAndFile[0],
-			"file":    diskStorageAndFile[1],
+		// Passthrough disks are a device path like /dev/disk/by-id/..., without storage.
+		diskConfMap := QemuDevice{"type": diskType, "storage": "", "file": diskConfList[0]}
+		if diskStorageAndFile := strings.SplitN(diskConfList[0], ":", 2); len(diskStorageAndFile) == 2 {
+			diskConfMap["storage"] = diskStorageAndFile[0]
+			diskConfMap["file"] = diskStorageAndFile[1]
 		}
 
 		// Add rest of device config.
 		diskConfMap.readDeviceConfig(diskConfList[1:])
+		if size, isSet := diskConfMap["size"]; isSet {
+			if diskConfMap["size"], err = normalizeDiskSize(size); err != nil {
+				return nil, fmt.Errorf("%s: %v", diskName, err)
+			}
+		}
 
 		// And device config to disks map.
 		if len(diskConfMap) > 0 {
@@ -301,6 +1518,19 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 		}
 	}
 
+	// Unused disks.
+	for k, v := range vmConfig {
+		if unusedName := rxUnusedDiskName.FindStringSubmatch(k); len(unusedName) > 0 {
+			id := rxDeviceID.FindStringSubmatch(unusedName[0])
+			unusedID, _ := strconv.Atoi(id[0])
+			unusedStorageAndFile := strings.SplitN(v.(string), ":", 2)
+			config.QemuUnusedDisks[unusedID] = QemuDevice{
+				"storage": unusedStorageAndFile[0],
+				"file":    unusedStorageAndFile[1],
+			}
+		}
+	}
+
 	// Networks.
 	nicNames := []string{}
 
@@ -333,6 +1563,22 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 			config.QemuNetworks[nicID] = nicConfMap
 		}
 	}
+
+	// PCI devices.
+	for k, v := range vmConfig {
+		if pciName := rxPCIName.FindStringSubmatch(k); len(pciName) > 0 {
+			id := rxDeviceID.FindStringSubmatch(pciName[0])
+			pciID, _ := strconv.Atoi(id[0])
+			pciConfList := strings.Split(v.(string), ",")
+			// host= is the default key and usually left out.
+			if !strings.Contains(pciConfList[0], "=") {
+				pciConfList[0] = "host=" + pciConfList[0]
+			}
+			pciConfMap := QemuDevice{}
+			pciConfMap.readDeviceConfig(pciConfList)
+			config.QemuPCIDevices[pciID] = pciConfMap
+		}
+	}
 	if _, isSet := vmConfig["ciuser"]; isSet {
 		config.CIuser = vmConfig["ciuser"].(string)
 	}
@@ -342,6 +1588,9 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 	if _, isSet := vmConfig["searchdomain"]; isSet {
 		config.Searchdomain = vmConfig["searchdomain"].(string)
 	}
+	if _, isSet := vmConfig["nameserver"]; isSet {
+		config.Nameserver = vmConfig["nameserver"].(string)
+	}
 	if _, isSet := vmConfig["sshkeys"]; isSet {
 		config.Sshkeys, _ = url.PathUnescape(vmConfig["sshkeys"].(string))
 	}
@@ -351,22 +1600,59 @@ func NewConfigQemuFromApi(vmr *VmRef, client *Client) (config *ConfigQemu, err e
 	if _, isSet := vmConfig["ipconfig1"]; isSet {
 		config.Ipconfig1 = vmConfig["ipconfig1"].(string)
 	}
+
+	// Keep what isn't modeled, so it is sent back on update.
+	config.ExtraConfig = map[string]interface{}{}
+	for key, value := range vmConfig {
+		if !config.isModeledKey(key) {
+			config.ExtraConfig[key] = value
+		}
+	}
 	return
 }
 
+// Numeric option from vmConfig, defaultValue when it isn't set.
+func vmConfigInt(vmConfig map[string]interface{}, key string, defaultValue int) (int, error) {
+	if _, isSet := vmConfig[key]; !isSet {
+		return defaultValue, nil
+	}
+	value, err := toInt(vmConfig[key])
+	if err != nil {
+		return 0, fmt.Errorf("%s: %v", key, err)
+	}
+	return value, nil
+}
+
+// Config keys read into typed ConfigQemu fields.
+var qemuConfigKeys = []string{
+	"name", "description", "onboot", "autostart", "protection", "reboot", "memory", "ostype", "cores", "sockets", "cpu", "affinity", "agent", "vmgenid", "args", "hookscript", "hotplug", "startup", "scsihw", "boot", "bootdisk",
+	"ciuser", "cipassword", "searchdomain", "nameserver", "sshkeys", "ipconfig0", "ipconfig1",
+}
+
+// Config keys describing VM state, Proxmox doesn't accept them back.
+var qemuReadOnlyKeys = []string{"digest", "lock", "meta", "parent"}
+
+func (config ConfigQemu) isModeledKey(key string) bool {
+	switch {
+	case inArray(qemuConfigKeys, key), inArray(qemuReadOnlyKeys, key):
+		return true
+	case key == "ide2" && config.QemuIso != "":
+		return true
+	case rxDiskName.MatchString(key):
+		// CD-ROM drives other than QemuIso aren't in QemuDisks.
+		diskID, _ := strconv.Atoi(rxDeviceID.FindString(key))
+		disk, isSet := config.QemuDisks[diskID]
+		return isSet && key == fmt.Sprintf("%v%d", disk["type"], diskID)
+	case rxNicName.MatchString(key),
+		rxUnusedDiskName.MatchString(key), rxPCIName.MatchString(key):
+		return true
+	}
+	return false
+}
+
 // Useful waiting for ISO install to complete
 func WaitForShutdown(vmr *VmRef, client *Client) (err error) {
-	for ii := 0; ii < 100; ii++ {
-		vmState, err := client.GetVmState(vmr)
-		if err != nil {
-			log.Print("Wait error:")
-			log.Println(err)
-		} else if vmState["status"] == "stopped" {
-			return nil
-		}
-		time.Sleep(5 * time.Second)
-	}
-	return errors.New("Not shutdown within wait time")
+	return client.WaitForStatus(vmr, "stopped", 500*time.Second)
 }
 
 // This is because proxmox create/config API won't let us make usernet devices
@@ -411,6 +1697,7 @@ func RemoveSshForwardUsernet(vmr *VmRef, client *Client) (err error) {
 	return nil
 }
 
+// MaxVmId - highest VMID in use, see ClusterNextId for allocating a new one
 func MaxVmId(client *Client) (max int, err error) {
 	resp, err := client.GetVmList()
 	vms := resp["data"].([]interface{})
@@ -492,56 +1779,62 @@ func SendKeysString(vmr *VmRef, client *Client, keys string) (err error) {
 }
 
 // Create parameters for each Nic device.
+// The only change made to c is writing generated MACs back into the "macaddr" of
+// the QemuNetworks entries that had none, so callers can store them (e.g. Terraform).
+// Use Clone first to keep the config untouched.
 func (c ConfigQemu) CreateQemuNetworksParams(vmID int, params map[string]interface{}) error {
 
 	// For backward compatibility.
 	if len(c.QemuNetworks) == 0 && len(c.QemuNicModel) > 0 {
 		deprecatedStyleMap := QemuDevice{
-			"type":   c.QemuNicModel,
+			"model":  c.QemuNicModel,
 			"bridge": c.QemuBrige,
 		}
 
 		if c.QemuVlanTag > 0 {
-			deprecatedStyleMap["tag"] = strconv.Itoa(c.QemuVlanTag)
+			deprecatedStyleMap["tag"] = c.QemuVlanTag
 		}
 
-		c.QemuNetworks[0] = deprecatedStyleMap
+		c.QemuNetworks = QemuDevices{0: deprecatedStyleMap}
 	}
 
 	// For new style with multi net device.
-	for nicID, nicConfMap := range c.QemuNetworks {
+	for _, nicID := range c.QemuNetworks.ids() {
+		nicConfMap := c.QemuNetworks[nicID]
 
 		nicConfParam := QemuDeviceParam{}
 
 		// Set Nic name.
 		qemuNicName := "net" + strconv.Itoa(nicID)
 
+		// Set model, Windows has no virtio drivers out of the box.
+		model, _ := nicConfMap["model"].(string)
+		if model == "" {
+			model = "virtio"
+			if c.isWindows() {
+				model = "e1000"
+			}
+		}
+		nicConfParam = append(nicConfParam, "model="+model)
+
 		// Set Mac address.
-		if nicConfMap["macaddr"].(string) == "" {
-			// Generate Mac based on VmID and NicID so it will be the same always.
-			macaddr := make(net.HardwareAddr, 6)
-			rand.Seed(int64(vmID + nicID))
-			rand.Read(macaddr)
-			macAddrUppr := strings.ToUpper(fmt.Sprintf("%v", macaddr))
-			macAddr := fmt.Sprintf("macaddr=%v", macAddrUppr)
-
-			// Add Mac to source map so it will be returned. (useful for some use case like Terraform)
-			nicConfMap["macaddr"] = macAddrUppr
-			// and also add it to the parameters which will be sent to Proxmox API.
-			nicConfParam = append(nicConfParam, macAddr)
-		} else {
-			macAddr := fmt.Sprintf("macaddr=%v", nicConfMap["macaddr"].(string))
-			nicConfParam = append(nicConfParam, macAddr)
+		macAddr, _ := nicConfMap["macaddr"].(string)
+		if macAddr == "" || c.RegenerateMacs {
+			macAddr = generateMacAddr(vmID, nicID)
+
+			// Documented write-back, see above.
+			nicConfMap["macaddr"] = macAddr
 		}
+		nicConfParam = append(nicConfParam, "macaddr="+macAddr)
 
 		// Set bridge if not nat.
-		if nicConfMap["bridge"].(string) != "nat" {
+		if bridge, _ := nicConfMap["bridge"].(string); bridge != "nat" {
 			bridge := fmt.Sprintf("bridge=%v", nicConfMap["bridge"])
 			nicConfParam = append(nicConfParam, bridge)
 		}
 
 		// Keys that are not used as real/direct conf.
-		ignoredKeys := []string{"id", "bridge", "macaddr"}
+		ignoredKeys := []string{"id", "bridge", "macaddr", "model"}
 
 		// Rest of config.
 		nicConfParam = nicConfParam.createDeviceParam(nicConfMap, ignoredKeys)
@@ -553,6 +1846,16 @@ func (c ConfigQemu) CreateQemuNetworksParams(vmID int, params map[string]interfa
 	return nil
 }
 
+// Generate Mac based on VmID and NicID so it will be the same always.
+// Each (vmID, nicID) pair gets its own seed (nics go up to net31), and the address is
+// made locally administered unicast as Proxmox rejects multicast ones.
+func generateMacAddr(vmID int, nicID int) string {
+	macaddr := make(net.HardwareAddr, 6)
+	rand.New(rand.NewSource(int64(vmID)<<8 | int64(nicID))).Read(macaddr)
+	macaddr[0] = macaddr[0]&0xfe | 0x02
+	return strings.ToUpper(fmt.Sprintf("%v", macaddr))
+}
+
 // Create parameters for each disk.
 func (c ConfigQemu) CreateQemuDisksParams(
 	vmID int,
@@ -561,29 +1864,53 @@ func (c ConfigQemu) CreateQemuDisksParams(
 ) error {
 
 	// For backward compatibility.
-	if len(c.QemuDisks) == 0 && len(c.Storage) > 0 {
+	// Only when creating, on clone Storage is the clone target and the disks come from the template.
+	if action == "create" && len(c.QemuDisks) == 0 && len(c.Storage) > 0 {
 		deprecatedStyleMap := QemuDevice{
+			"type":    "virtio",
 			"storage": c.Storage,
-			"size":    c.DiskSize,
+			"size":    fmt.Sprintf("%vG", c.DiskSize),
 		}
 
-		c.QemuDisks[0] = deprecatedStyleMap
+		c.QemuDisks = QemuDevices{0: deprecatedStyleMap}
 	}
 
 	// For new style with multi disk device.
-	for diskID, diskConfMap := range c.QemuDisks {
+	for _, diskID := range c.QemuDisks.ids() {
+		diskConfMap := c.QemuDisks[diskID]
 
 		diskConfParam := QemuDeviceParam{}
 
 		// Device name.
-		deviceType := diskConfMap["type"].(string)
+		deviceType, _ := diskConfMap["type"].(string)
+		if deviceType == "" {
+			deviceType = c.defaultDiskType()
+		}
 		qemuDiskName := deviceType + strconv.Itoa(diskID)
+		maxIndex, isBus := qemuDiskBusMaxIndex[deviceType]
+		if !isBus {
+			return fmt.Errorf("disk %d: invalid type '%s', expected ide, sata, scsi or virtio", diskID, deviceType)
+		}
+		if diskID < 0 || diskID > maxIndex {
+			return fmt.Errorf("%s: %s disks are numbered 0-%d", qemuDiskName, deviceType, maxIndex)
+		}
+
+		storageType, _ := diskConfMap["storage_type"].(string)
+		givenFormat, _ := diskConfMap["format"].(string)
+		format, err := diskFormat(storageType, givenFormat)
+		if err != nil {
+			return fmt.Errorf("%s: %v", qemuDiskName, err)
+		}
+		if file, _ := diskConfMap["file"].(string); file != "" {
+			// Existing volume, its format is already decided.
+			format = givenFormat
+		}
 
 		// Set disk storage.
 		if action == "create" {
 
 			// Disk size.
-			diskSizeGB := diskConfMap["size"].(string)
+			diskSizeGB := fmt.Sprintf("%v", diskConfMap["size"])
 			diskSize := strings.Trim(diskSizeGB, "G")
 			diskStorage := fmt.Sprintf("%v:%v", diskConfMap["storage"], diskSize)
 			diskConfParam = append(diskConfParam, diskStorage)
@@ -602,23 +1929,33 @@ func (c ConfigQemu) CreateQemuDisksParams(
 			// Currently ZFS local, LVM, and Directory are considered.
 			// Other formats are not verified, but could be added if they're needed.
 			rxStorageTypes := `(zfspool|lvm)`
-			storageType := diskConfMap["storage_type"].(string)
-			if matched, _ := regexp.MatchString(rxStorageTypes, storageType); matched {
+			file, _ := diskConfMap["file"].(string)
+			if storage, _ := diskConfMap["storage"].(string); file != "" && storage == "" {
+				// Passthrough device path.
+				diskFile = "file=" + file
+			} else if file != "" {
+				// The real volume is known, e.g. read back from a clone.
+				diskFile = fmt.Sprintf("file=%v:%v", diskConfMap["storage"], file)
+			} else if matched, _ := regexp.MatchString(rxStorageTypes, storageType); matched {
 				diskFile = fmt.Sprintf("file=%v:vm-%v-disk-%v", diskConfMap["storage"], vmID, diskID+1)
 			} else {
-				diskFile = fmt.Sprintf("file=%v:%v/vm-%v-disk-%v.%v", diskConfMap["storage"], vmID, vmID, diskID+1, diskConfMap["format"])
+				diskFile = fmt.Sprintf("file=%v:%v/vm-%v-disk-%v.%v", diskConfMap["storage"], vmID, vmID, diskID+1, format)
 			}
 			diskConfParam = append(diskConfParam, diskFile)
 		}
 
 		// Set cache if not none (default).
-		if diskConfMap["cache"].(string) != "none" {
+		if cache, _ := diskConfMap["cache"].(string); cache != "" && cache != "none" {
 			diskCache := fmt.Sprintf("cache=%v", diskConfMap["cache"])
 			diskConfParam = append(diskConfParam, diskCache)
 		}
 
+		if format != "" {
+			diskConfParam = append(diskConfParam, "format="+format)
+		}
+
 		// Keys that are not used as real/direct conf.
-		ignoredKeys := []string{"id", "type", "storage", "storage_type", "size", "cache"}
+		ignoredKeys := []string{"id", "type", "storage", "storage_type", "size", "cache", "file", "format"}
 
 		// Rest of config.
 		diskConfParam = diskConfParam.createDeviceParam(diskConfMap, ignoredKeys)
@@ -630,21 +1967,133 @@ func (c ConfigQemu) CreateQemuDisksParams(
 	return nil
 }
 
+// Bus of disks without a type: sata on Windows, which has no virtio drivers out of the box,
+// virtio otherwise. Set the disk type to use another one.
+func (c ConfigQemu) defaultDiskType() string {
+	if c.isWindows() {
+		return "sata"
+	}
+	return "virtio"
+}
+
+// NextFreeDiskIndex - lowest N without a busTypeN (e.g. scsiN) device in vmConfig (GetVmConfig),
+// an error when all slots of the bus are taken.
+func NextFreeDiskIndex(vmConfig map[string]interface{}, busType string) (int, error) {
+	maxIndex, isBus := qemuDiskBusMaxIndex[busType]
+	if !isBus {
+		return -1, fmt.Errorf("invalid disk bus '%s', expected ide, sata, scsi or virtio", busType)
+	}
+	for diskID := 0; diskID <= maxIndex; diskID++ {
+		if _, isSet := vmConfig[busType+strconv.Itoa(diskID)]; !isSet {
+			return diskID, nil
+		}
+	}
+	return -1, fmt.Errorf("all %s slots (0-%d) in use", busType, maxIndex)
+}
+
+// NextFreeNetIndex - lowest N without a netN device in vmConfig (GetVmConfig)
+func NextFreeNetIndex(vmConfig map[string]interface{}) int {
+	nicID := 0
+	for {
+		if _, isSet := vmConfig["net"+strconv.Itoa(nicID)]; !isSet {
+			return nicID
+		}
+		nicID++
+	}
+}
+
+// Highest device index Proxmox accepts per disk bus.
+var qemuDiskBusMaxIndex = map[string]int{"ide": 3, "sata": 5, "scsi": 30, "virtio": 15}
+
+var qemuDiskFormats = []string{"raw", "qcow2", "vmdk", "subvol"}
+
+// Storage types holding disks as block devices, they only take raw images.
+var blockStorageTypes = []string{"lvm", "lvmthin", "zfspool", "zfs", "rbd", "iscsi", "iscsidirect"}
+
+// Disk format to use on storageType: format checked against the storage,
+// or the storage's usual format when empty. An unknown storage type leaves the choice to Proxmox.
+func diskFormat(storageType string, format string) (string, error) {
+	if format != "" && !inArray(qemuDiskFormats, format) {
+		return "", fmt.Errorf("invalid format '%s', expected one of: %s", format, strings.Join(qemuDiskFormats, ", "))
+	}
+	switch {
+	case storageType == "":
+		return format, nil
+	case inArray(blockStorageTypes, storageType):
+		if format == "" {
+			return "raw", nil
+		}
+		if format != "raw" && !(format == "subvol" && storageType == "zfspool") {
+			return "", fmt.Errorf("format %s not supported on %s storage, use raw", format, storageType)
+		}
+	case format == "":
+		return "qcow2", nil
+	case format == "subvol" && storageType != "dir":
+		return "", fmt.Errorf("format subvol not supported on %s storage", storageType)
+	}
+	return format, nil
+}
+
+// Device options where 0/false is not the Proxmox default (or has to be set explicitly),
+// these are sent even when disabled. ro=1 makes a disk read-only, e.g. a shared golden image.
+var deviceParamsAlwaysEmitted = []string{"backup", "firewall", "link_down", "replicate", "ro"}
+
+// Create parameters for each PCI passthrough device.
+func (c ConfigQemu) CreateQemuPCIsParams(params map[string]interface{}) error {
+	for _, pciID := range c.QemuPCIDevices.ids() {
+		pciConfMap := c.QemuPCIDevices[pciID]
+		qemuPCIName := "hostpci" + strconv.Itoa(pciID)
+
+		host, _ := pciConfMap["host"].(string)
+		if host == "" {
+			return fmt.Errorf("%s: host (PCI id) is required", qemuPCIName)
+		}
+		if mdev, isSet := pciConfMap["mdev"]; isSet && mdev == "" {
+			return fmt.Errorf("%s: mdev must not be empty, e.g. mdev=nvidia-35", qemuPCIName)
+		}
+		pciConfParam := QemuDeviceParam{"host=" + host}
+
+		// Rest of config.
+		pciConfParam = pciConfParam.createDeviceParam(pciConfMap, []string{"id", "host"})
+
+		// Add back to Qemu prams.
+		params[qemuPCIName] = strings.Join(pciConfParam, ",")
+	}
+
+	return nil
+}
+
 // Create the parameters for each device that will be sent to Proxmox API.
 func (p QemuDeviceParam) createDeviceParam(
 	deviceConfMap QemuDevice,
 	ignoredKeys []string,
 ) QemuDeviceParam {
 
-	for key, value := range deviceConfMap {
+	keys := make([]string, 0, len(deviceConfMap))
+	for key := range deviceConfMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		value := deviceConfMap[key]
 		if ignored := inArray(ignoredKeys, key); !ignored {
 			var confValue interface{}
+			alwaysEmitted := inArray(deviceParamsAlwaysEmitted, key)
 			if bValue, ok := value.(bool); ok && bValue {
 				confValue = "1"
+			} else if ok && alwaysEmitted {
+				confValue = "0"
 			} else if sValue, ok := value.(string); ok && len(sValue) > 0 {
 				confValue = sValue
-			} else if iValue, ok := value.(int); ok && iValue > 0 {
+			} else if lValue, ok := value.([]string); ok && len(lValue) > 0 {
+				// List values, e.g. trunks or flags.
+				confValue = strings.Join(lValue, ";")
+			} else if iValue, ok := value.(int); ok && (iValue > 0 || alwaysEmitted) {
 				confValue = iValue
+			} else if fValue, ok := value.(float64); ok && (fValue > 0 || alwaysEmitted) {
+				// Numbers decoded from JSON.
+				confValue = fValue
 			}
 			if confValue != nil {
 				deviceConf := fmt.Sprintf("%v=%v", key, confValue)
@@ -656,16 +2105,29 @@ func (p QemuDeviceParam) createDeviceParam(
 	return p
 }
 
+// Device options that stay strings even when they look numeric, e.g. serial=0042.
+// wwn, product and vendor are the SCSI identity some guest software keys on.
+// trunks and flags are ;-separated lists, e.g. trunks=10;20;30 or flags=+aes;+pcid.
+var deviceStringKeys = []string{"file", "serial", "trunks", "flags", "wwn", "product", "vendor"}
+
 // Parse standard sub-conf strings where `key=value` and update conf map.
 func (confMap QemuDevice) readDeviceConfig(confList []string) error {
 	// Add device config.
 	for _, confs := range confList {
-		conf := strings.Split(confs, "=")
+		// Values may contain "=" themselves, e.g. base64 or paths.
+		conf := strings.SplitN(confs, "=", 2)
 		key := conf[0]
+		if len(conf) == 1 {
+			// Options without a value are flags.
+			confMap[key] = true
+			continue
+		}
 		value := conf[1]
 		// Make sure to add value in right type because
 		// all subconfig are returned as strings from Proxmox API.
-		if iValue, err := strconv.ParseInt(value, 10, 64); err == nil {
+		if inArray(deviceStringKeys, key) || strings.Contains(value, ";") {
+			confMap[key] = value
+		} else if iValue, err := strconv.ParseInt(value, 10, 64); err == nil {
 			confMap[key] = int(iValue)
 		} else if bValue, err := strconv.ParseBool(value); err == nil {
 			confMap[key] = bValue
@@ -0,0 +1,192 @@
+package proxmox
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// QemuDiskBuilder - builds a disk QemuDevice for ConfigQemu.QemuDisks
+type QemuDiskBuilder struct {
+	device QemuDevice
+}
+
+// NewDisk - e.g. NewDisk().Storage("local").SizeGB(32).Type("scsi").Cache("writeback").Build()
+func NewDisk() *QemuDiskBuilder {
+	return &QemuDiskBuilder{device: QemuDevice{}}
+}
+
+// Type - bus of the disk: ide, sata, scsi or virtio
+func (b *QemuDiskBuilder) Type(diskType string) *QemuDiskBuilder {
+	b.device["type"] = diskType
+	return b
+}
+
+func (b *QemuDiskBuilder) Storage(storage string) *QemuDiskBuilder {
+	b.device["storage"] = storage
+	return b
+}
+
+// StorageType - Proxmox storage type of Storage (dir, lvm, zfspool, ...)
+func (b *QemuDiskBuilder) StorageType(storageType string) *QemuDiskBuilder {
+	b.device["storage_type"] = storageType
+	return b
+}
+
+func (b *QemuDiskBuilder) SizeGB(size int) *QemuDiskBuilder {
+	b.device["size"] = fmt.Sprintf("%dG", size)
+	return b
+}
+
+// Cache - none, writethrough, writeback, unsafe or directsync
+func (b *QemuDiskBuilder) Cache(cache string) *QemuDiskBuilder {
+	b.device["cache"] = cache
+	return b
+}
+
+// Format - raw, qcow2 or vmdk
+func (b *QemuDiskBuilder) Format(format string) *QemuDiskBuilder {
+	b.device["format"] = format
+	return b
+}
+
+// Option - any other disk option, sent as key=value
+func (b *QemuDiskBuilder) Option(key string, value interface{}) *QemuDiskBuilder {
+	b.device[key] = value
+	return b
+}
+
+// Build - a copy of the disk map, the builder can be reused
+func (b *QemuDiskBuilder) Build() QemuDevice {
+	return b.device.copy()
+}
+
+// QemuNicBuilder - builds a network QemuDevice for ConfigQemu.QemuNetworks
+type QemuNicBuilder struct {
+	device QemuDevice
+}
+
+// NewNic - e.g. NewNic().Model("virtio").Bridge("vmbr0").Tag(100).Build()
+func NewNic() *QemuNicBuilder {
+	return &QemuNicBuilder{device: QemuDevice{}}
+}
+
+// Model - e1000, virtio, rtl8139 or vmxnet3
+func (b *QemuNicBuilder) Model(model string) *QemuNicBuilder {
+	b.device["model"] = model
+	return b
+}
+
+// Bridge - host bridge, "nat" for user networking
+func (b *QemuNicBuilder) Bridge(bridge string) *QemuNicBuilder {
+	b.device["bridge"] = bridge
+	return b
+}
+
+// MacAddr - left empty, one is generated from the vmid
+func (b *QemuNicBuilder) MacAddr(macaddr string) *QemuNicBuilder {
+	b.device["macaddr"] = macaddr
+	return b
+}
+
+// Tag - VLAN tag
+func (b *QemuNicBuilder) Tag(tag int) *QemuNicBuilder {
+	b.device["tag"] = tag
+	return b
+}
+
+func (b *QemuNicBuilder) Firewall(firewall bool) *QemuNicBuilder {
+	b.device["firewall"] = firewall
+	return b
+}
+
+// Option - any other network option, sent as key=value
+func (b *QemuNicBuilder) Option(key string, value interface{}) *QemuNicBuilder {
+	b.device[key] = value
+	return b
+}
+
+// Build - a copy of the network map, the builder can be reused
+func (b *QemuNicBuilder) Build() QemuDevice {
+	return b.device.copy()
+}
+
+func (device QemuDevice) copy() QemuDevice {
+	deviceCopy := QemuDevice{}
+	for key, value := range device {
+		deviceCopy[key] = value
+	}
+	return deviceCopy
+}
+
+// ParseDeviceString - parses a Proxmox property string like "model=virtio,bridge=vmbr0,firewall=1".
+// Values may be double quoted to contain commas, options without a value (flags) are set to true.
+func ParseDeviceString(s string) QemuDevice {
+	device := QemuDevice{}
+	for _, option := range splitDeviceString(s) {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) == 2 {
+			if value, quoted := unquoteDeviceValue(keyValue[1]); quoted {
+				device[keyValue[0]] = value
+				continue
+			}
+		}
+		device.readDeviceConfig([]string{option})
+	}
+	return device
+}
+
+// FormatDeviceString - the reverse of ParseDeviceString, ignored keys are left out.
+// true is written as a flag and values with commas are quoted. Proxmox has no escaping,
+// so values can't contain double quotes.
+func FormatDeviceString(d QemuDevice, ignored []string) string {
+	keys := make([]string, 0, len(d))
+	for key := range d {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	options := QemuDeviceParam{}
+	for _, key := range keys {
+		value := d[key]
+		if bValue, isBool := value.(bool); isBool && bValue {
+			if !inArray(ignored, key) {
+				options = append(options, key)
+			}
+			continue
+		}
+		if sValue, isString := value.(string); isString && strings.Contains(sValue, ",") {
+			value = `"` + sValue + `"`
+		}
+		options = options.createDeviceParam(QemuDevice{key: value}, ignored)
+	}
+	return strings.Join(options, ",")
+}
+
+// Split on the commas which are not inside a quoted value.
+func splitDeviceString(s string) (options []string) {
+	var option strings.Builder
+	quoted := false
+	for _, r := range s {
+		if r == '"' {
+			quoted = !quoted
+		} else if r == ',' && !quoted {
+			if option.Len() > 0 {
+				options = append(options, option.String())
+			}
+			option.Reset()
+			continue
+		}
+		option.WriteRune(r)
+	}
+	if option.Len() > 0 {
+		options = append(options, option.String())
+	}
+	return
+}
+
+func unquoteDeviceValue(value string) (string, bool) {
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return value, false
+	}
+	return value[1 : len(value)-1], true
+}
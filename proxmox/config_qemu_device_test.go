@@ -0,0 +1,72 @@
+package proxmox
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDeviceString(t *testing.T) {
+	device := ParseDeviceString(`virtio=AA:BB:CC:DD:EE:FF,bridge=vmbr0,firewall=1,link_down,trunks=10;20,tag=100,comment="a,b"`)
+	want := QemuDevice{
+		"virtio":    "AA:BB:CC:DD:EE:FF",
+		"bridge":    "vmbr0",
+		"firewall":  1,
+		"link_down": true,
+		"trunks":    "10;20",
+		"tag":       100,
+		"comment":   "a,b",
+	}
+	if !reflect.DeepEqual(device, want) {
+		t.Errorf("device = %v, want %v", device, want)
+	}
+}
+
+func TestDeviceStringRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		"bridge=vmbr0,firewall=1,model=virtio",
+		"discard,file=local-lvm:vm-100-disk-0,iothread=1,ssd",
+		`comment="rack 4, shelf 2",media=cdrom`,
+		`args="-cpu host,kvm=off",ro`,
+		"cputype=host,flags=+pcid;-spec-ctrl",
+		"bridge=vmbr0,trunks=10;20;30",
+		"cicustom=user=local:snippets/user.yaml",
+	} {
+		device := ParseDeviceString(s)
+		formatted := FormatDeviceString(device, nil)
+		if formatted != s {
+			t.Errorf("FormatDeviceString(ParseDeviceString(%q)) = %q", s, formatted)
+		}
+		if reparsed := ParseDeviceString(formatted); !reflect.DeepEqual(reparsed, device) {
+			t.Errorf("%q reparsed = %v, want %v", formatted, reparsed, device)
+		}
+	}
+}
+
+func TestFormatDeviceStringIgnored(t *testing.T) {
+	device := QemuDevice{"id": 0, "type": "scsi", "storage": "local-lvm", "size": "8G", "ssd": true, "backup": false}
+	if formatted := FormatDeviceString(device, []string{"id", "type", "ssd"}); formatted != "backup=0,size=8G,storage=local-lvm" {
+		t.Errorf("formatted = %q, want backup=0,size=8G,storage=local-lvm", formatted)
+	}
+}
+
+func TestQemuDiskBuilder(t *testing.T) {
+	builder := NewDisk().Type("scsi").Storage("local-lvm").StorageType("lvmthin").SizeGB(32).Cache("writeback").Option("ssd", true)
+	want := QemuDevice{"type": "scsi", "storage": "local-lvm", "storage_type": "lvmthin", "size": "32G", "cache": "writeback", "ssd": true}
+	disk := builder.Build()
+	if !reflect.DeepEqual(disk, want) {
+		t.Errorf("disk = %v, want %v", disk, want)
+	}
+	// Build copies, the builder can go on for the next disk.
+	other := builder.SizeGB(64).Format("raw").Build()
+	if disk["size"] != "32G" || other["size"] != "64G" || other["format"] != "raw" {
+		t.Errorf("disk = %v, other = %v", disk, other)
+	}
+}
+
+func TestQemuNicBuilder(t *testing.T) {
+	nic := NewNic().Model("virtio").Bridge("vmbr0").Tag(100).Firewall(true).MacAddr("AA:BB:CC:DD:EE:01").Option("mtu", 9000).Build()
+	want := QemuDevice{"model": "virtio", "bridge": "vmbr0", "tag": 100, "firewall": true, "macaddr": "AA:BB:CC:DD:EE:01", "mtu": 9000}
+	if !reflect.DeepEqual(nic, want) {
+		t.Errorf("nic = %v, want %v", nic, want)
+	}
+}
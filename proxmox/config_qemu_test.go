@@ -0,0 +1,1050 @@
+package proxmox
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestNewConfigQemuFromVmConfigCdrom(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"sata0":   "local:iso/foo.iso,media=cdrom",
+		"ide2":    "local:iso/install.iso,media=cdrom",
+		"virtio1": "local-lvm:vm-100-disk-0,size=8G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.QemuDisks) != 1 || config.QemuDisks[1]["type"] != "virtio" {
+		t.Errorf("QemuDisks = %v, want only virtio1", config.QemuDisks)
+	}
+	if config.QemuIso != "local:iso/install.iso" {
+		t.Errorf("QemuIso = %q, want local:iso/install.iso", config.QemuIso)
+	}
+	if _, isSet := config.ExtraConfig["sata0"]; !isSet {
+		t.Errorf("sata0 cdrom not kept in ExtraConfig: %v", config.ExtraConfig)
+	}
+}
+
+func TestNewConfigQemuFromVmConfigCloudInitDrive(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"ide2":  "local-lvm:vm-100-cloudinit,media=cdrom",
+		"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.QemuIso != "" {
+		t.Errorf("QemuIso = %q, want the cloud-init drive not taken as ISO", config.QemuIso)
+	}
+	if config.ExtraConfig["ide2"] != "local-lvm:vm-100-cloudinit,media=cdrom" {
+		t.Errorf("cloud-init drive not kept in ExtraConfig: %v", config.ExtraConfig)
+	}
+	if len(config.QemuDisks) != 1 || config.TotalDiskGB() != 8 {
+		t.Errorf("QemuDisks = %v, want only scsi0", config.QemuDisks)
+	}
+}
+
+func TestNewConfigQemuFromVmConfigPassthroughDisk(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"scsi1": "/dev/disk/by-id/ata-ST4000VN008_ZDH1,size=3726G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := config.QemuDisks[1]
+	if disk["storage"] != "" || disk["file"] != "/dev/disk/by-id/ata-ST4000VN008_ZDH1" {
+		t.Errorf("scsi1 = %v, want the device path as file without storage", disk)
+	}
+	params := map[string]interface{}{}
+	if err = config.CreateQemuDisksParams(100, "update", params); err != nil {
+		t.Fatal(err)
+	}
+	if want := "size=3726G,file=/dev/disk/by-id/ata-ST4000VN008_ZDH1"; params["scsi1"] != want {
+		t.Errorf("scsi1 param = %v, want %s", params["scsi1"], want)
+	}
+}
+
+func TestNewConfigQemuFromVmConfigSharedIndex(t *testing.T) {
+	vmConfig := map[string]interface{}{
+		"virtio0": "local-lvm:vm-100-disk-1,size=16G",
+		"scsi0":   "local-lvm:vm-100-disk-0,size=8G",
+	}
+	for ii := 0; ii < 10; ii++ {
+		config, err := newConfigQemuFromVmConfig(vmConfig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if config.QemuDisks[0]["type"] != "scsi" {
+			t.Fatalf("disk 0 = %v, want scsi0", config.QemuDisks[0])
+		}
+		if config.ExtraConfig["virtio0"] != vmConfig["virtio0"] {
+			t.Fatalf("virtio0 not kept in ExtraConfig: %v", config.ExtraConfig)
+		}
+	}
+}
+
+func TestCreateQemuDisksParamsDefaultBus(t *testing.T) {
+	tests := []struct {
+		os   string
+		want string
+	}{
+		{OsTypeWin10, "sata0"},
+		{OsTypeWin11, "sata0"},
+		{OsTypeLinux26, "virtio0"},
+		{"", "virtio0"},
+	}
+	for _, test := range tests {
+		config := ConfigQemu{QemuOs: test.os, QemuDisks: QemuDevices{0: {"storage": "local-lvm", "size": "8G"}}}
+		params := map[string]interface{}{}
+		if err := config.CreateQemuDisksParams(100, "create", params); err != nil {
+			t.Fatal(err)
+		}
+		if params[test.want] != "local-lvm:8" {
+			t.Errorf("ostype %q: params = %v, want %s", test.os, params, test.want)
+		}
+	}
+	// An explicit type wins over the default.
+	config := ConfigQemu{QemuOs: OsTypeWin10, QemuDisks: QemuDevices{0: {"type": "scsi", "storage": "local-lvm", "size": "8G"}}}
+	params := map[string]interface{}{}
+	if err := config.CreateQemuDisksParams(100, "create", params); err != nil {
+		t.Fatal(err)
+	}
+	if _, isSet := params["scsi0"]; !isSet {
+		t.Errorf("params = %v, want scsi0", params)
+	}
+}
+
+func TestDiffUntypedDiskExisting(t *testing.T) {
+	for _, test := range []struct{ os, disk string }{{OsTypeLinux26, "virtio0"}, {OsTypeWin10, "sata0"}} {
+		current, err := newConfigQemuFromVmConfig(map[string]interface{}{
+			"ostype":  test.os,
+			test.disk: "local-lvm:vm-100-disk-0,size=8G",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		desired := ConfigQemu{QemuOs: test.os, QemuDisks: QemuDevices{0: {"storage": "local-lvm", "size": "8G"}}}
+		changes, err := desired.Diff(NewVmRef(100), *current)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if change, isSet := changes[test.disk]; isSet {
+			t.Errorf("%s: untyped disk sent as %s=%v, want it matched to the existing disk", test.os, test.disk, change)
+		}
+	}
+}
+
+var diffVmConfig = map[string]interface{}{
+	"name":        "web1",
+	"description": "web server",
+	"ostype":      "l26",
+	"memory":      float64(2048),
+	"cores":       float64(2),
+	"sockets":     float64(1),
+	"onboot":      float64(1),
+	"protection":  float64(1),
+	"scsi0":       "local-lvm:vm-100-disk-0,size=8G",
+	"net0":        "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr0",
+	"net1":        "virtio=AA:BB:CC:DD:EE:02,bridge=vmbr1",
+	"smbios1":     "uuid=0b1b8e2e-3c43-4a0c-9c36-0c1b4c1f2c55",
+}
+
+func TestDiffIdentical(t *testing.T) {
+	current, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := current.Clone().Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", changes)
+	}
+}
+
+func TestDiffScalars(t *testing.T) {
+	current, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.Memory = 4096
+	changes, err := desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes["memory"] != 4096 {
+		t.Errorf("changes = %v, want only memory=4096", changes)
+	}
+
+	desired = current.Clone()
+	desired.Onboot = false
+	desired.QemuCores = 4
+	changes, err = desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes["onboot"] != 0 || changes["cores"] != 4 {
+		t.Errorf("changes = %v, want onboot=0 and cores=4", changes)
+	}
+}
+
+func TestDiffClearsOptions(t *testing.T) {
+	vmConfig := map[string]interface{}{"agent": float64(1), "hookscript": "local:snippets/hook.sh"}
+	for key, value := range diffVmConfig {
+		vmConfig[key] = value
+	}
+	current, err := newConfigQemuFromVmConfig(vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.Description = ""
+	desired.HookScript = ""
+	desired.Agent = 0
+	// Left at 0 the size is kept.
+	desired.Memory = 0
+	changes, err := desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 2 || changes["delete"] != "description,hookscript" || changes["agent"] != 0 {
+		t.Errorf("changes = %v, want delete=description,hookscript and agent=0", changes)
+	}
+}
+
+func TestDiffDevices(t *testing.T) {
+	current, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.QemuDisks[1] = QemuDevice{"type": "scsi", "storage": "local-lvm", "size": "16G"}
+	desired.QemuNetworks[0]["bridge"] = "vmbr2"
+	delete(desired.QemuNetworks, 1)
+	changes, err := desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"scsi1":  "local-lvm:16",
+		"net0":   "model=virtio,macaddr=AA:BB:CC:DD:EE:01,bridge=vmbr2",
+		"delete": "net1",
+	}
+	if len(changes) != len(want) {
+		t.Errorf("changes = %v, want %v", changes, want)
+	}
+	for key, value := range want {
+		if changes[key] != value {
+			t.Errorf("%s = %v, want %v", key, changes[key], value)
+		}
+	}
+}
+
+func TestDiffRemovedDevices(t *testing.T) {
+	vmConfig := map[string]interface{}{"scsi1": "local-lvm:vm-100-disk-1,size=16G"}
+	for key, value := range diffVmConfig {
+		vmConfig[key] = value
+	}
+	current, err := newConfigQemuFromVmConfig(vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	delete(desired.QemuDisks, 1)
+	desired.Description = ""
+	changes, err := desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes["delete"] != "description,scsi1" {
+		t.Errorf("changes = %v, want delete=description,scsi1", changes)
+	}
+
+	// No devices at all is a VM without disks and nics.
+	desired.QemuDisks = QemuDevices{}
+	desired.QemuNetworks = QemuDevices{}
+	changes, err = desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes["delete"] != "description,net0,net1,scsi0,scsi1" {
+		t.Errorf("changes = %v, want all disks and nics deleted", changes)
+	}
+}
+
+func TestNewConfigQemuFromVmConfigLockProtection(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"lock": "backup", "protection": float64(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Lock != "backup" {
+		t.Errorf("Lock = %q, want backup", config.Lock)
+	}
+	if config.Protection == nil || !*config.Protection {
+		t.Errorf("Protection = %v, want true", config.Protection)
+	}
+	if _, isSet := config.ExtraConfig["lock"]; isSet {
+		t.Errorf("read-only lock sent back in ExtraConfig")
+	}
+}
+
+func TestDiffKeepsProtection(t *testing.T) {
+	current, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes, err := ConfigQemu{Onboot: true}.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isSet := changes["protection"]; isSet {
+		t.Errorf("changes = %v, want protection left as it is", changes)
+	}
+	protection := false
+	changes, err = ConfigQemu{Onboot: true, Protection: &protection}.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if changes["protection"] != 0 {
+		t.Errorf("changes = %v, want protection=0", changes)
+	}
+}
+
+func TestBuildCreateParamsBools(t *testing.T) {
+	vmr := NewVmRef(100)
+	params, err := ConfigQemu{Name: "web1", Onboot: true}.BuildCreateParams(vmr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["onboot"] != 1 {
+		t.Errorf("onboot = %#v, want 1", params["onboot"])
+	}
+	if _, isSet := params["autostart"]; isSet {
+		t.Errorf("autostart = %#v, want it left to Proxmox", params["autostart"])
+	}
+
+	autostart := false
+	params, err = ConfigQemu{Name: "web1", Autostart: &autostart}.BuildCreateParams(vmr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["onboot"] != 0 || params["autostart"] != 0 {
+		t.Errorf("onboot = %#v, autostart = %#v, want 0 and 0", params["onboot"], params["autostart"])
+	}
+	body := string(ParamsToBody(params))
+	for _, want := range []string{"onboot=0", "autostart=0"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("body %s lacks %s", body, want)
+		}
+	}
+}
+
+func TestGenerateMacAddr(t *testing.T) {
+	if generateMacAddr(100, 0) != generateMacAddr(100, 0) {
+		t.Errorf("MAC of vm 100 net0 not stable")
+	}
+	seen := map[string]string{}
+	for vmID := 100; vmID < 200; vmID++ {
+		for nicID := 0; nicID < 4; nicID++ {
+			macaddr := generateMacAddr(vmID, nicID)
+			name := fmt.Sprintf("vm %d net%d", vmID, nicID)
+			if other, isSet := seen[macaddr]; isSet {
+				t.Fatalf("%s has the MAC %s of %s", name, macaddr, other)
+			}
+			seen[macaddr] = name
+			hwAddr, err := net.ParseMAC(macaddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if hwAddr[0]&0x01 != 0 || hwAddr[0]&0x02 == 0 {
+				t.Errorf("%s: %s is not a locally administered unicast MAC", name, macaddr)
+			}
+		}
+	}
+}
+
+func TestCreateQemuNetworksParamsRegenerateMacs(t *testing.T) {
+	templateMac := "AA:BB:CC:DD:EE:01"
+	config := ConfigQemu{RegenerateMacs: true, QemuNetworks: QemuDevices{0: {"bridge": "vmbr0", "macaddr": templateMac}}}
+	params := map[string]interface{}{}
+	if err := config.CreateQemuNetworksParams(101, params); err != nil {
+		t.Fatal(err)
+	}
+	macaddr := config.QemuNetworks[0]["macaddr"]
+	if macaddr == templateMac || macaddr != generateMacAddr(101, 0) {
+		t.Errorf("macaddr = %v, want the regenerated %s", macaddr, generateMacAddr(101, 0))
+	}
+	if !strings.Contains(params["net0"].(string), "macaddr="+generateMacAddr(101, 0)) {
+		t.Errorf("net0 = %v, want the regenerated MAC", params["net0"])
+	}
+}
+
+func TestConfigQemuStringRedacted(t *testing.T) {
+	config := ConfigQemu{Name: "web1", CIpassword: "s3cret", Sshkeys: "ssh-ed25519 AAAAC3Nza me@host"}
+	for _, printed := range []string{config.String(), config.GoString(), fmt.Sprintf("%v", config), fmt.Sprintf("%+v", &config), fmt.Sprintf("%#v", config)} {
+		if strings.Contains(printed, "s3cret") || strings.Contains(printed, "AAAAC3Nza") {
+			t.Errorf("secret printed: %s", printed)
+		}
+		if !strings.Contains(printed, "web1") {
+			t.Errorf("name missing: %s", printed)
+		}
+	}
+	if config.CIpassword != "s3cret" {
+		t.Errorf("redaction changed the config")
+	}
+}
+
+func TestBuildCreateParams(t *testing.T) {
+	config := ConfigQemu{
+		Name:         "web1",
+		QemuOs:       OsTypeLinux26,
+		Memory:       2048,
+		QemuCores:    2,
+		QemuSockets:  1,
+		QemuDisks:    QemuDevices{0: {"type": "scsi", "storage": "local-lvm", "storage_type": "lvmthin", "size": "8G"}},
+		QemuNetworks: QemuDevices{0: {"model": "virtio", "bridge": "vmbr0", "macaddr": "AA:BB:CC:DD:EE:01"}},
+	}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"vmid":   100,
+		"name":   "web1",
+		"ostype": OsTypeLinux26,
+		"memory": 2048,
+		"cores":  2,
+		"scsi0":  "local-lvm:8,format=raw",
+		"net0":   "model=virtio,macaddr=AA:BB:CC:DD:EE:01,bridge=vmbr0",
+	}
+	for key, value := range want {
+		if params[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, params[key], value)
+		}
+	}
+}
+
+func TestParseQemuIpConfig(t *testing.T) {
+	tests := []struct {
+		ipconfig string
+		want     QemuIpConfig
+	}{
+		{"ip=dhcp", QemuIpConfig{IP: "dhcp"}},
+		{"ip=10.0.0.5/24,gw=10.0.0.1", QemuIpConfig{IP: "10.0.0.5/24", Gateway: "10.0.0.1"}},
+		{"ip6=auto", QemuIpConfig{IP6: "auto"}},
+		{"ip=10.0.0.5/24,gw=10.0.0.1,ip6=2001:db8::5/64,gw6=2001:db8::1",
+			QemuIpConfig{IP: "10.0.0.5/24", Gateway: "10.0.0.1", IP6: "2001:db8::5/64", Gateway6: "2001:db8::1"}},
+	}
+	for _, test := range tests {
+		ipConfig, err := ParseQemuIpConfig(test.ipconfig)
+		if err != nil {
+			t.Errorf("%s: %v", test.ipconfig, err)
+			continue
+		}
+		if ipConfig != test.want {
+			t.Errorf("%s: %+v, want %+v", test.ipconfig, ipConfig, test.want)
+		}
+		if ipConfig.String() != test.ipconfig {
+			t.Errorf("%s: String() = %s", test.ipconfig, ipConfig.String())
+		}
+	}
+	for _, ipconfig := range []string{
+		"ip=10.0.0.5",
+		"ip=2001:db8::5/64",
+		"ip=dhcp,gw=10.0.0.1",
+		"ip6=10.0.0.5/24",
+		"ip6=auto,gw6=2001:db8::1",
+		"ip=10.0.0.5/24,gw=2001:db8::1",
+		"dhcp",
+		"ip=dhcp,mtu=1500",
+	} {
+		if _, err := ParseQemuIpConfig(ipconfig); err == nil {
+			t.Errorf("%s accepted", ipconfig)
+		}
+	}
+}
+
+func TestReadDeviceConfig(t *testing.T) {
+	device := QemuDevice{}
+	device.readDeviceConfig([]string{
+		"cicustom=user=local:snippets/user.yaml",
+		"args=-fw_cfg name=opt/x,string=y",
+		"tag=100",
+		"firewall=1",
+		"ssd",
+		"cache=writeback",
+	})
+	want := QemuDevice{
+		"cicustom": "user=local:snippets/user.yaml",
+		"args":     "-fw_cfg name=opt/x,string=y",
+		"tag":      100,
+		"firewall": 1,
+		"ssd":      true,
+		"cache":    "writeback",
+	}
+	for key, value := range want {
+		if device[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, device[key], value)
+		}
+	}
+}
+
+func TestReadDeviceConfigLists(t *testing.T) {
+	device := QemuDevice{}
+	device.readDeviceConfig([]string{"trunks=10;20;30", "flags=+pcid", "hostpci=0000:01:00.0;0000:01:00.1"})
+	want := QemuDevice{"trunks": "10;20;30", "flags": "+pcid", "hostpci": "0000:01:00.0;0000:01:00.1"}
+	for key, value := range want {
+		if device[key] != value {
+			t.Errorf("%s = %#v, want %#v", key, device[key], value)
+		}
+	}
+}
+
+func TestCreateDeviceParamLists(t *testing.T) {
+	nic := QemuDevice{"model": "virtio", "bridge": "vmbr0", "trunks": []string{"10", "20"}, "firewall": false, "tag": 0}
+	param := strings.Join(QemuDeviceParam{}.createDeviceParam(nic, []string{"model"}), ",")
+	if param != "bridge=vmbr0,firewall=0,trunks=10;20" {
+		t.Errorf("param = %s, want bridge=vmbr0,firewall=0,trunks=10;20", param)
+	}
+}
+
+func TestParseBootOrder(t *testing.T) {
+	tests := []struct {
+		vmConfig map[string]interface{}
+		want     []string
+	}{
+		{map[string]interface{}{"boot": "order=scsi0;ide2;net0"}, []string{"scsi0", "ide2", "net0"}},
+		{map[string]interface{}{"boot": "order=scsi0;;net0;"}, []string{"scsi0", "net0"}},
+		{map[string]interface{}{
+			"boot": "dcn", "bootdisk": "virtio0", "ide2": "local:iso/install.iso,media=cdrom",
+			"net1": "virtio=AA:BB:CC:DD:EE:02,bridge=vmbr1", "net0": "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr0",
+		}, []string{"ide2", "virtio0", "net0", "net1"}},
+		// No cdrom in ide2, so no d.
+		{map[string]interface{}{"boot": "dc", "bootdisk": "scsi0", "ide2": "local-lvm:vm-100-cloudinit,media=disk"}, []string{"scsi0"}},
+		// Proxmox defaults to cdn.
+		{map[string]interface{}{"bootdisk": "sata0"}, []string{"sata0"}},
+		{map[string]interface{}{}, nil},
+	}
+	for _, test := range tests {
+		bootOrder := parseBootOrder(test.vmConfig)
+		if strings.Join(bootOrder, ";") != strings.Join(test.want, ";") || (bootOrder == nil) != (test.want == nil) {
+			t.Errorf("%v: boot order %#v, want %#v", test.vmConfig, bootOrder, test.want)
+		}
+	}
+}
+
+func TestBootOrderParams(t *testing.T) {
+	config := ConfigQemu{Name: "web1", BootOrder: []string{"scsi0", "net0"}}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["boot"] != "order=scsi0;net0" {
+		t.Errorf("boot = %v, want order=scsi0;net0", params["boot"])
+	}
+	config.BootOrder = []string{"scsi0", "floppy0"}
+	if err = config.Validate(); err == nil {
+		t.Errorf("boot device floppy0 accepted")
+	}
+
+	current, err := newConfigQemuFromVmConfig(map[string]interface{}{"boot": "cdn", "bootdisk": "scsi0", "scsi0": "local-lvm:vm-100-disk-0,size=8G"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	desired := current.Clone()
+	desired.BootOrder = []string{"scsi0"}
+	changes, err := desired.Diff(NewVmRef(100), *current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want the legacy boot order taken as the same", changes)
+	}
+}
+
+func TestAffinity(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"affinity": "0-3,8-11"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Affinity != "0-3,8-11" {
+		t.Errorf("Affinity = %q, want 0-3,8-11", config.Affinity)
+	}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["affinity"] != "0-3,8-11" {
+		t.Errorf("affinity = %v, want 0-3,8-11", params["affinity"])
+	}
+	for _, affinity := range []string{"0-3,", "0-3;8", "a-b", "0--3", " 1"} {
+		if err = (ConfigQemu{Affinity: affinity}).Validate(); err == nil {
+			t.Errorf("affinity %q accepted", affinity)
+		}
+	}
+}
+
+func TestBuildCreateParamsMinimal(t *testing.T) {
+	params, err := ConfigQemu{}.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Only what can't be left to Proxmox, cpu defaults to host rather than kvm64.
+	if len(params) != 3 || params["vmid"] != 100 || params["onboot"] != 0 || params["cpu"] != "host" {
+		t.Errorf("params = %v, want only vmid, onboot and cpu", params)
+	}
+	if _, isSet := params["ide2"]; isSet {
+		t.Errorf("ide2 = %v without QemuIso", params["ide2"])
+	}
+
+	params, err = ConfigQemu{QemuIso: "local:iso/debian-12.iso"}.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["ide2"] != "local:iso/debian-12.iso,media=cdrom" {
+		t.Errorf("ide2 = %v, want the ISO as cdrom", params["ide2"])
+	}
+}
+
+func TestNewConfigQemuFromVmConfigUnusedDisks(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"scsi0":   "local-lvm:vm-100-disk-0,size=8G",
+		"unused0": "local-lvm:vm-100-disk-1",
+		"unused3": "ceph:vm-100-disk-4",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.QemuUnusedDisks) != 2 {
+		t.Fatalf("QemuUnusedDisks = %v, want unused0 and unused3", config.QemuUnusedDisks)
+	}
+	for unusedID, want := range map[int]QemuDevice{0: {"storage": "local-lvm", "file": "vm-100-disk-1"}, 3: {"storage": "ceph", "file": "vm-100-disk-4"}} {
+		unused := config.QemuUnusedDisks[unusedID]
+		if unused["storage"] != want["storage"] || unused["file"] != want["file"] {
+			t.Errorf("unused%d = %v, want %v", unusedID, unused, want)
+		}
+	}
+	if len(config.QemuDisks) != 1 || len(config.ExtraConfig) != 0 {
+		t.Errorf("QemuDisks = %v, ExtraConfig = %v, want only scsi0 as disk", config.QemuDisks, config.ExtraConfig)
+	}
+}
+
+func TestCreateQemuNetworksParamsDefaultModel(t *testing.T) {
+	tests := []struct {
+		os   string
+		want string
+	}{
+		{OsTypeLinux26, "model=virtio,"},
+		{"", "model=virtio,"},
+		{OsTypeWin10, "model=e1000,"},
+		{OsTypeWin11, "model=e1000,"},
+	}
+	for _, test := range tests {
+		config := ConfigQemu{QemuOs: test.os, QemuNetworks: QemuDevices{0: {"bridge": "vmbr0"}}}
+		params := map[string]interface{}{}
+		if err := config.CreateQemuNetworksParams(100, params); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(params["net0"].(string), test.want) {
+			t.Errorf("ostype %q: net0 = %v, want %s", test.os, params["net0"], test.want)
+		}
+	}
+	// An explicit model wins.
+	config := ConfigQemu{QemuOs: OsTypeWin10, QemuNetworks: QemuDevices{0: {"model": "virtio", "bridge": "vmbr0"}}}
+	params := map[string]interface{}{}
+	if err := config.CreateQemuNetworksParams(100, params); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(params["net0"].(string), "model=virtio,") {
+		t.Errorf("net0 = %v, want model=virtio", params["net0"])
+	}
+}
+
+func TestNicVlanRoundTrip(t *testing.T) {
+	net0 := "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr0,tag=100,trunks=10;20;30"
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"net0": net0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	nic := config.QemuNetworks[0]
+	if nic["tag"] != 100 || nic["trunks"] != "10;20;30" {
+		t.Errorf("net0 = %v, want tag 100 and trunks 10;20;30", nic)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]interface{}{}
+	if err = config.CreateQemuNetworksParams(100, params); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"tag=100", "trunks=10;20;30"} {
+		if !strings.Contains(params["net0"].(string), option) {
+			t.Errorf("net0 = %v, want %s", params["net0"], option)
+		}
+	}
+
+	for _, nic := range []QemuDevice{
+		{"bridge": "vmbr0", "tag": 4095},
+		{"bridge": "vmbr0", "tag": "abc"},
+		{"bridge": "vmbr0", "trunks": "10;abc"},
+		{"bridge": "vmbr0", "trunks": "10;5000"},
+	} {
+		if err := (ConfigQemu{QemuNetworks: QemuDevices{0: nic}}).Validate(); err == nil {
+			t.Errorf("nic %v accepted", nic)
+		}
+	}
+}
+
+func TestVmGenId(t *testing.T) {
+	vmGenId := "c4a7e5b2-1f3d-4e8a-9b6c-0d2e4f6a8b1c"
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"vmgenid": vmGenId})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.VmGenId != vmGenId {
+		t.Errorf("VmGenId = %q, want %q", config.VmGenId, vmGenId)
+	}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["vmgenid"] != vmGenId {
+		t.Errorf("vmgenid = %v, want %s", params["vmgenid"], vmGenId)
+	}
+
+	for _, invalid := range []string{"1", "c4a7e5b2-1f3d-4e8a-9b6c", "c4a7e5b2-1f3d-4e8a-9b6c-0d2e4f6a8b1z"} {
+		if err := (ConfigQemu{VmGenId: invalid}).Validate(); err == nil {
+			t.Errorf("vmgenid %q accepted", invalid)
+		}
+	}
+
+	generated, err := GenerateVmGenId()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !rxUuid.MatchString(generated) || generated[14] != '4' {
+		t.Errorf("GenerateVmGenId = %q, want a version 4 UUID", generated)
+	}
+	if other, _ := GenerateVmGenId(); other == generated {
+		t.Errorf("GenerateVmGenId returned %q twice", generated)
+	}
+}
+
+func TestPCIDevicesRoundTrip(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"hostpci0": "0000:01:00.0,mdev=nvidia-35,pcie=1",
+		"hostpci2": "host=0000:02:00.0",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.QemuPCIDevices) != 2 || len(config.ExtraConfig) != 0 {
+		t.Fatalf("QemuPCIDevices = %v, ExtraConfig = %v, want hostpci0 and hostpci2", config.QemuPCIDevices, config.ExtraConfig)
+	}
+	pci := config.QemuPCIDevices[0]
+	if pci["host"] != "0000:01:00.0" || pci["mdev"] != "nvidia-35" {
+		t.Errorf("hostpci0 = %v, want host 0000:01:00.0 and mdev nvidia-35", pci)
+	}
+	params := map[string]interface{}{}
+	if err = config.CreateQemuPCIsParams(params); err != nil {
+		t.Fatal(err)
+	}
+	hostpci0 := params["hostpci0"].(string)
+	if !strings.HasPrefix(hostpci0, "host=0000:01:00.0,") || !strings.Contains(hostpci0, "mdev=nvidia-35") || !strings.Contains(hostpci0, "pcie=1") {
+		t.Errorf("hostpci0 = %q, want host, mdev and pcie", hostpci0)
+	}
+	if params["hostpci2"] != "host=0000:02:00.0" {
+		t.Errorf("hostpci2 = %v, want host=0000:02:00.0", params["hostpci2"])
+	}
+
+	for _, pci := range []QemuDevice{{"mdev": "nvidia-35"}, {"host": "0000:01:00.0", "mdev": ""}} {
+		if err := (ConfigQemu{QemuPCIDevices: QemuDevices{0: pci}}).CreateQemuPCIsParams(map[string]interface{}{}); err == nil {
+			t.Errorf("hostpci %v accepted", pci)
+		}
+	}
+}
+
+func TestTotalDiskGB(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"scsi0":   "local-lvm:vm-100-disk-0,size=32G",
+		"scsi1":   "local-lvm:vm-100-disk-1,size=512M",
+		"virtio2": "ceph:vm-100-disk-2,size=1T",
+		"ide3":    "local-lvm:vm-100-cloudinit,size=4M",
+		"ide2":    "local:iso/install.iso,media=cdrom,size=700M",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total := config.TotalDiskGB(); total != 32+0.5+1024 {
+		t.Errorf("TotalDiskGB = %v, want 1056.5", total)
+	}
+	config = &ConfigQemu{QemuDisks: QemuDevices{0: {"size": 20}, 1: {"size": "2048M"}, 2: {"size": "10"}}}
+	if total := config.TotalDiskGB(); total != 32 {
+		t.Errorf("TotalDiskGB = %v, want 32", total)
+	}
+	// For backward compatibility.
+	if total := (ConfigQemu{DiskSize: 16}).TotalDiskGB(); total != 16 {
+		t.Errorf("TotalDiskGB = %v, want DiskSize 16", total)
+	}
+}
+
+func TestCpuFlagsRoundTrip(t *testing.T) {
+	for cpu, want := range map[string]string{
+		"host,flags=+aes;-pcid":                    "host,flags=+aes;-pcid",
+		"cputype=kvm64,flags=+md-clear;+spec-ctrl": "kvm64,flags=+md-clear;+spec-ctrl",
+		"x86-64-v2-AES":                            "x86-64-v2-AES",
+	} {
+		config, err := newConfigQemuFromVmConfig(map[string]interface{}{"cpu": cpu})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = config.Validate(); err != nil {
+			t.Errorf("cpu %q: %v", cpu, err)
+		}
+		params, err := config.BuildCreateParams(NewVmRef(100))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params["cpu"] != want {
+			t.Errorf("cpu %q sent as %v, want %s", cpu, params["cpu"], want)
+		}
+	}
+	for _, flags := range [][]string{{"aes"}, {"+aes", "pcid"}, {"+"}, {""}} {
+		if err := (ConfigQemu{QemuCpuFlags: flags}).Validate(); err == nil {
+			t.Errorf("cpu flags %q accepted", flags)
+		}
+	}
+}
+
+func TestHookScriptRoundTrip(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"hookscript": "local:snippets/hook.pl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.HookScript != "local:snippets/hook.pl" || len(config.ExtraConfig) != 0 {
+		t.Errorf("HookScript = %q, ExtraConfig = %v, want local:snippets/hook.pl", config.HookScript, config.ExtraConfig)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["hookscript"] != "local:snippets/hook.pl" {
+		t.Errorf("hookscript = %v, want local:snippets/hook.pl", params["hookscript"])
+	}
+	for _, hookScript := range []string{"hook.pl", "local:iso/hook.pl", ":snippets/hook.pl", "local:snippets/"} {
+		if err := (ConfigQemu{HookScript: hookScript}).Validate(); err == nil {
+			t.Errorf("hookscript %q accepted", hookScript)
+		}
+	}
+}
+
+func TestDiskIdentityRoundTrip(t *testing.T) {
+	scsi0 := "local-lvm:vm-100-disk-0,product=ST4000NM0035,size=8G,vendor=SEAGATE,wwn=0x5000c500a1b2c3d4"
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{"scsi0": scsi0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	disk := config.QemuDisks[0]
+	if disk["wwn"] != "0x5000c500a1b2c3d4" || disk["vendor"] != "SEAGATE" || disk["product"] != "ST4000NM0035" {
+		t.Errorf("scsi0 = %v, want wwn, vendor and product as strings", disk)
+	}
+	if err = config.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	params := map[string]interface{}{}
+	if err = config.CreateQemuDisksParams(100, "update", params); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"wwn=0x5000c500a1b2c3d4", "vendor=SEAGATE", "product=ST4000NM0035"} {
+		if !strings.Contains(params["scsi0"].(string), option) {
+			t.Errorf("scsi0 = %v, want %s", params["scsi0"], option)
+		}
+	}
+	for _, wwn := range []string{"5000c500a1b2c3d4", "0x5000c500a1b2c3", "0x5000c500a1b2c3dg"} {
+		config := ConfigQemu{QemuDisks: QemuDevices{0: {"type": "scsi", "storage": "local-lvm", "size": "8G", "wwn": wwn}}}
+		if err := config.Validate(); err == nil {
+			t.Errorf("wwn %q accepted", wwn)
+		}
+	}
+}
+
+func TestWindowsOptimize(t *testing.T) {
+	config := ConfigQemu{QemuOs: OsTypeWin11, QemuCpu: "kvm64", QemuCpuFlags: []string{"+aes"}}
+	config.WindowsOptimize()
+	// Applying it twice doesn't repeat the flag.
+	config.WindowsOptimize()
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params["cpu"] != "host,flags=+aes;+hv-tlbflush" || params["machine"] != "q35" || params["ostype"] != OsTypeWin11 {
+		t.Errorf("cpu = %v, machine = %v, ostype = %v, want host with +hv-tlbflush on q35", params["cpu"], params["machine"], params["ostype"])
+	}
+	if _, isSet := params["args"]; isSet {
+		t.Errorf("args = %v, the enlightenments are Proxmox's", params["args"])
+	}
+
+	// A machine type already chosen is kept.
+	config = ConfigQemu{QemuOs: OsTypeWin10, ExtraConfig: map[string]interface{}{"machine": "pc-q35-8.1"}}
+	config.WindowsOptimize()
+	if config.ExtraConfig["machine"] != "pc-q35-8.1" {
+		t.Errorf("machine = %v, want pc-q35-8.1 kept", config.ExtraConfig["machine"])
+	}
+}
+
+func TestValidateStartup(t *testing.T) {
+	if err := (ConfigQemu{Onboot: true, Startup: "order=2,up=30,down=60"}).Validate(); err != nil {
+		t.Error(err)
+	}
+	err := (ConfigQemu{Startup: "order=2"}).Validate()
+	if err == nil || !strings.Contains(err.Error(), "set onboot") {
+		t.Errorf("err = %v, want startup without onboot rejected", err)
+	}
+	for _, startup := range []string{"order", "first=1", "order=two", "order=1,up"} {
+		if err := (ConfigQemu{Onboot: true, Startup: startup}).Validate(); err == nil {
+			t.Errorf("startup %q accepted", startup)
+		}
+	}
+}
+
+func TestDiskReadOnlyReplicateRoundTrip(t *testing.T) {
+	config, err := newConfigQemuFromVmConfig(map[string]interface{}{
+		"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+		"scsi1": "ceph:vm-100-disk-1,replicate=0,ro=1,size=32G",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if disk := config.QemuDisks[1]; disk["ro"] != 1 || disk["replicate"] != 0 {
+		t.Errorf("scsi1 = %v, want ro 1 and replicate 0", disk)
+	}
+	params := map[string]interface{}{}
+	if err = config.CreateQemuDisksParams(100, "update", params); err != nil {
+		t.Fatal(err)
+	}
+	for _, option := range []string{"ro=1", "replicate=0"} {
+		if !strings.Contains(params["scsi1"].(string), option) {
+			t.Errorf("scsi1 = %v, want %s", params["scsi1"], option)
+		}
+	}
+	// Unset is left to the Proxmox defaults, read-write and replicated.
+	for _, option := range []string{"ro=", "replicate="} {
+		if strings.Contains(params["scsi0"].(string), option) {
+			t.Errorf("scsi0 = %v, want no %s", params["scsi0"], option)
+		}
+	}
+}
+
+func TestNextFreeIndex(t *testing.T) {
+	vmConfig := map[string]interface{}{
+		"scsi0": "local-lvm:vm-100-disk-0,size=8G",
+		"scsi1": "local-lvm:vm-100-disk-1,size=8G",
+		"scsi3": "local-lvm:vm-100-disk-3,size=8G",
+		"sata2": "local-lvm:vm-100-disk-2,size=8G",
+		"net0":  "virtio=AA:BB:CC:DD:EE:01,bridge=vmbr0",
+		"net2":  "virtio=AA:BB:CC:DD:EE:03,bridge=vmbr0",
+	}
+	for busType, want := range map[string]int{"scsi": 2, "sata": 0, "virtio": 0} {
+		if diskID, err := NextFreeDiskIndex(vmConfig, busType); err != nil || diskID != want {
+			t.Errorf("NextFreeDiskIndex(%s) = %d, %v, want %d", busType, diskID, err, want)
+		}
+	}
+	if nicID := NextFreeNetIndex(vmConfig); nicID != 1 {
+		t.Errorf("NextFreeNetIndex = %d, want 1", nicID)
+	}
+	if _, err := NextFreeDiskIndex(vmConfig, "nvme"); err == nil {
+		t.Errorf("bus nvme accepted")
+	}
+	for ii := 0; ii <= 3; ii++ {
+		vmConfig[fmt.Sprintf("ide%d", ii)] = "none,media=cdrom"
+	}
+	if _, err := NextFreeDiskIndex(vmConfig, "ide"); err == nil {
+		t.Errorf("no error with all ide slots taken")
+	}
+}
+
+func TestNewConfigQemuFromVmConfigMeta(t *testing.T) {
+	vmConfig := map[string]interface{}{"meta": "creation-qemu=8.1.5,ctime=1712345678"}
+	for key, value := range diffVmConfig {
+		vmConfig[key] = value
+	}
+	config, err := newConfigQemuFromVmConfig(vmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Meta != "creation-qemu=8.1.5,ctime=1712345678" {
+		t.Errorf("Meta = %q, want the creation metadata", config.Meta)
+	}
+	if _, isSet := config.ExtraConfig["meta"]; isSet {
+		t.Errorf("meta in ExtraConfig, it would be sent back")
+	}
+	params, err := config.BuildCreateParams(NewVmRef(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, isSet := params["meta"]; isSet {
+		t.Errorf("meta sent on create: %v", params["meta"])
+	}
+
+	// Older Proxmox has no meta.
+	withoutMeta, err := newConfigQemuFromVmConfig(diffVmConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if withoutMeta.Meta != "" || withoutMeta.Name != config.Name {
+		t.Errorf("Meta = %q, Name = %q, want no meta and the rest parsed", withoutMeta.Meta, withoutMeta.Name)
+	}
+	// Nor is it a change to make.
+	changes, err := withoutMeta.Diff(NewVmRef(100), *config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 0 {
+		t.Errorf("changes = %v, want none", changes)
+	}
+}
+
+func TestDeviceParamsStableOrder(t *testing.T) {
+	config := ConfigQemu{
+		QemuNetworks: QemuDevices{
+			0: {"model": "virtio", "macaddr": "AA:BB:CC:DD:EE:01", "bridge": "vmbr0", "tag": 100, "mtu": 9000, "queues": 4, "rate": 100},
+			1: {"model": "virtio", "macaddr": "AA:BB:CC:DD:EE:02", "bridge": "vmbr1", "firewall": true, "link_down": false},
+		},
+		QemuDisks: QemuDevices{
+			0: {"type": "scsi", "storage": "local-lvm", "file": "vm-100-disk-0", "size": "8G", "iothread": 1, "discard": "on", "ssd": 1, "cache": "none", "backup": true},
+		},
+	}
+	build := func() map[string]interface{} {
+		params := map[string]interface{}{}
+		if err := config.CreateQemuNetworksParams(100, params); err != nil {
+			t.Fatal(err)
+		}
+		if err := config.CreateQemuDisksParams(100, "update", params); err != nil {
+			t.Fatal(err)
+		}
+		return params
+	}
+	first := build()
+	if first["net0"] != "model=virtio,macaddr=AA:BB:CC:DD:EE:01,bridge=vmbr0,mtu=9000,queues=4,rate=100,tag=100" {
+		t.Errorf("net0 = %v, want the options in key order", first["net0"])
+	}
+	if first["net1"] != "model=virtio,macaddr=AA:BB:CC:DD:EE:02,bridge=vmbr1,firewall=1,link_down=0" {
+		t.Errorf("net1 = %v, want the options in key order", first["net1"])
+	}
+	// Map iteration order changes between runs, the params don't.
+	for ii := 0; ii < 50; ii++ {
+		params := build()
+		for key, value := range first {
+			if params[key] != value {
+				t.Fatalf("run %d: %s = %v, first run %v", ii, key, params[key], value)
+			}
+		}
+	}
+}
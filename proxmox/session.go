@@ -14,15 +14,91 @@ import (
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"regexp"
+	"sort"
+	"strings"
 )
 
 var Debug = new(bool)
 
+// Logger - destination of the package's log messages (Debug dumps, warnings), see SetLogger
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// The standard log package, unless replaced with SetLogger.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, v ...interface{}) {
+	log.Printf(format, v...)
+}
+
+type silentLogger struct{}
+
+func (silentLogger) Printf(format string, v ...interface{}) {}
+
+var logger Logger = stdLogger{}
+
+// SetLogger - route the package's log messages to l, e.g. a *log.Logger; nil silences them.
+func SetLogger(l Logger) {
+	if l == nil {
+		l = silentLogger{}
+	}
+	logger = l
+}
+
 type Response struct {
 	Resp *http.Response
 	Body []byte
 }
 
+// ProxmoxAPIError - details of a request rejected by the Proxmox API
+// Errors holds the per-parameter messages Proxmox returns on validation failures.
+type ProxmoxAPIError struct {
+	StatusCode int
+	Status     string
+	Path       string
+	Errors     map[string]string
+}
+
+func (e *ProxmoxAPIError) Error() string {
+	msg := fmt.Sprintf("%s: %s", e.Path, e.Status)
+	params := make([]string, 0, len(e.Errors))
+	for param := range e.Errors {
+		params = append(params, param)
+	}
+	sort.Strings(params)
+	for _, param := range params {
+		msg += fmt.Sprintf("\n%s: %s", param, strings.TrimSpace(e.Errors[param]))
+	}
+	return msg
+}
+
+// NewProxmoxAPIError - build an error from a failed API response, consuming and closing its body
+func NewProxmoxAPIError(path string, resp *http.Response) *ProxmoxAPIError {
+	defer resp.Body.Close()
+	apiErr := &ProxmoxAPIError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		Path:       path,
+		Errors:     map[string]string{},
+	}
+	rbody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return apiErr
+	}
+	var jbody map[string]interface{}
+	if err = json.Unmarshal(rbody, &jbody); err != nil {
+		return apiErr
+	}
+	if errs, isMap := jbody["errors"].(map[string]interface{}); isMap {
+		for param, msg := range errs {
+			apiErr.Errors[param] = fmt.Sprintf("%v", msg)
+		}
+	}
+	return apiErr
+}
+
 type Session struct {
 	httpClient *http.Client
 	ApiUrl     string
@@ -55,6 +131,12 @@ func ParamsToBody(params map[string]interface{}) (body []byte) {
 	for k, intrV := range params {
 		var v string
 		switch intrV.(type) {
+		case []string:
+			// Repeated param, e.g. command=ls&command=-l
+			for _, listV := range intrV.([]string) {
+				vals.Add(k, listV)
+			}
+			continue
 		case bool:
 			if intrV.(bool) {
 				v = "1"
@@ -73,7 +155,8 @@ func ParamsToBody(params map[string]interface{}) (body []byte) {
 func ResponseJSON(resp *http.Response) (jbody map[string]interface{}) {
 	rbody, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		log.Fatal(fmt.Sprintf("error reading response body: %s", err))
+		logger.Printf("error reading response body: %s", err)
+		return nil
 	}
 	if err = json.Unmarshal(rbody, &jbody); err != nil {
 		return nil
@@ -104,6 +187,14 @@ func (s *Session) Login(username string, password string) (err error) {
 	return nil
 }
 
+// Logout - forget the ticket, requests are unauthenticated until the next Login.
+// Proxmox tickets are signed, not stored, so there is nothing to revoke server side:
+// a copied ticket stays valid until it expires (2 hours).
+func (s *Session) Logout() {
+	s.AuthTicket = ""
+	s.CsrfToken = ""
+}
+
 func (s *Session) NewRequest(method, url string, headers *http.Header, body io.Reader) (req *http.Request, err error) {
 	req, err = http.NewRequest(method, url, body)
 	if err != nil {
@@ -119,6 +210,17 @@ func (s *Session) NewRequest(method, url string, headers *http.Header, body io.R
 	return
 }
 
+// Form params kept out of the Debug request dumps.
+var rxSecretParams = regexp.MustCompile(`\b(cipassword|password|sshkeys)=[^&\s]*`)
+
+// Monitor commands carrying a password, e.g. set_password spice <password>.
+var rxSecretMonitorCmds = regexp.MustCompile(`\b(command=set_password)[^&\s]*`)
+
+func redactSecrets(dump []byte) []byte {
+	dump = rxSecretParams.ReplaceAll(dump, []byte("${1}=<redacted>"))
+	return rxSecretMonitorCmds.ReplaceAll(dump, []byte("${1}+<redacted>"))
+}
+
 func (s *Session) Do(req *http.Request) (*http.Response, error) {
 	// Add session headers
 	for k := range s.Headers {
@@ -127,7 +229,8 @@ func (s *Session) Do(req *http.Request) (*http.Response, error) {
 
 	if *Debug {
 		d, _ := httputil.DumpRequestOut(req, true)
-		log.Printf(">>>>>>>>>> REQUEST:\n", string(d))
+		d = redactSecrets(d)
+		logger.Printf(">>>>>>>>>> REQUEST:\n%s", string(d))
 	}
 
 	resp, err := s.httpClient.Do(req)
@@ -136,7 +239,7 @@ func (s *Session) Do(req *http.Request) (*http.Response, error) {
 	}
 	if *Debug {
 		dr, _ := httputil.DumpResponse(resp, true)
-		log.Printf("<<<<<<<<<< RESULT:\n", string(dr))
+		logger.Printf("<<<<<<<<<< RESULT:\n%s", string(dr))
 	}
 
 	return resp, nil
@@ -151,6 +254,7 @@ func (s *Session) Request(
 	body *[]byte,
 ) (resp *http.Response, err error) {
 	// add params to url here
+	path := url
 	url = s.ApiUrl + url
 	if params != nil {
 		url = url + "?" + params.Encode()
@@ -174,6 +278,11 @@ func (s *Session) Request(
 		return nil, err
 	}
 
+	// Proxmox reports failures with a 4xx/5xx status and an "errors" map in the body.
+	if resp.StatusCode >= http.StatusBadRequest {
+		return nil, NewProxmoxAPIError(path, resp)
+	}
+
 	return resp, nil
 }
 
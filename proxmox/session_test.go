@@ -0,0 +1,143 @@
+package proxmox
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+)
+
+type closeRecorder struct {
+	*strings.Reader
+	closed bool
+}
+
+func (body *closeRecorder) Close() error {
+	body.closed = true
+	return nil
+}
+
+func TestNewProxmoxAPIError(t *testing.T) {
+	body := &closeRecorder{Reader: strings.NewReader(`{"errors":{"memory":"value must have a minimum value of 16\n",` +
+		`"cores":"type check ('integer') failed - got 'two'"},"data":null}`)}
+	resp := &http.Response{StatusCode: http.StatusBadRequest, Status: "400 Parameter verification failed.", Body: body}
+	apiErr := NewProxmoxAPIError("/nodes/pve1/qemu/100/config", resp)
+	if !body.closed {
+		t.Errorf("response body not closed")
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Path != "/nodes/pve1/qemu/100/config" {
+		t.Errorf("error = %+v", apiErr)
+	}
+	if len(apiErr.Errors) != 2 || apiErr.Errors["cores"] != "type check ('integer') failed - got 'two'" {
+		t.Errorf("Errors = %v, want memory and cores", apiErr.Errors)
+	}
+	want := "/nodes/pve1/qemu/100/config: 400 Parameter verification failed.\n" +
+		"cores: type check ('integer') failed - got 'two'\n" +
+		"memory: value must have a minimum value of 16"
+	if apiErr.Error() != want {
+		t.Errorf("Error() = %q, want %q", apiErr.Error(), want)
+	}
+
+	// A body that isn't JSON still gives the status.
+	apiErr = NewProxmoxAPIError("/version", &http.Response{StatusCode: http.StatusBadGateway, Status: "502 Bad Gateway",
+		Body: ioutil.NopCloser(strings.NewReader("<html>"))})
+	if apiErr.StatusCode != http.StatusBadGateway || len(apiErr.Errors) != 0 {
+		t.Errorf("error = %+v", apiErr)
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	body := string(ParamsToBody(map[string]interface{}{
+		"cipassword": "s3cret",
+		"sshkeys":    "ssh-ed25519%20AAAAC3Nza%20me%40host",
+		"ciuser":     "admin",
+	}))
+	dump := string(redactSecrets([]byte("POST /api2/json/nodes/pve/qemu/100/config HTTP/1.1\r\n\r\n" + body)))
+	for _, secret := range []string{"s3cret", "AAAAC3Nza"} {
+		if strings.Contains(dump, secret) {
+			t.Errorf("dump leaks %s: %s", secret, dump)
+		}
+	}
+	for _, want := range []string{"cipassword=<redacted>", "sshkeys=<redacted>", "ciuser=admin"} {
+		if !strings.Contains(dump, want) {
+			t.Errorf("dump lacks %s: %s", want, dump)
+		}
+	}
+}
+
+func TestRedactSecretsMonitorPassword(t *testing.T) {
+	body := string(ParamsToBody(map[string]interface{}{"command": "set_password spice Tr0ub4dor"}))
+	dump := string(redactSecrets([]byte(body)))
+	if strings.Contains(dump, "Tr0ub4dor") || !strings.Contains(dump, "command=set_password+<redacted>") {
+		t.Errorf("dump = %s, want the password redacted", dump)
+	}
+	body = string(ParamsToBody(map[string]interface{}{"command": "info status"}))
+	if dump = string(redactSecrets([]byte(body))); dump != body {
+		t.Errorf("dump = %s, want other monitor commands as they are", dump)
+	}
+}
+
+type recordingLogger struct {
+	lines []string
+}
+
+func (l *recordingLogger) Printf(format string, v ...interface{}) {
+	l.lines = append(l.lines, fmt.Sprintf(format, v...))
+}
+
+// Debug on with l as the logger until the test ends.
+func debugWithLogger(t *testing.T, l Logger) {
+	oldDebug := *Debug
+	*Debug = true
+	SetLogger(l)
+	t.Cleanup(func() {
+		*Debug = oldDebug
+		SetLogger(stdLogger{})
+	})
+}
+
+func TestSetLoggerNil(t *testing.T) {
+	var stdOutput bytes.Buffer
+	log.SetOutput(&stdOutput)
+	defer log.SetOutput(os.Stderr)
+	debugWithLogger(t, nil)
+	if _, isSilent := logger.(silentLogger); !isSilent {
+		t.Errorf("logger = %T, want silentLogger", logger)
+	}
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	if _, err := client.SetVmConfig(qemuVmRef(100, "pve1"), map[string]interface{}{"memory": 2048}); err != nil {
+		t.Fatal(err)
+	}
+	if stdOutput.Len() != 0 {
+		t.Errorf("logged with a nil logger: %s", stdOutput.String())
+	}
+}
+
+func TestDebugLogRedacted(t *testing.T) {
+	recorder := &recordingLogger{}
+	debugWithLogger(t, recorder)
+	client, fake := newFakeClient(t)
+	fake.okTask("POST /nodes/pve1/qemu/100/config", "pve1")
+	_, err := client.SetVmConfig(qemuVmRef(100, "pve1"), map[string]interface{}{
+		"cipassword": "s3cret",
+		"sshkeys":    "ssh-ed25519%20AAAAC3Nza%20me%40host",
+		"ciuser":     "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	logged := strings.Join(recorder.lines, "\n")
+	if !strings.Contains(logged, "ciuser=admin") {
+		t.Errorf("request not logged: %s", logged)
+	}
+	for _, secret := range []string{"s3cret", "AAAAC3Nza"} {
+		if strings.Contains(logged, secret) {
+			t.Errorf("log leaks %s: %s", secret, logged)
+		}
+	}
+}
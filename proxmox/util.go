@@ -1,5 +1,10 @@
 package proxmox
 
+import (
+	"fmt"
+	"strconv"
+)
+
 func inArray(arr []string, str string) bool {
 	for _, elem := range arr {
 		if elem == str {
@@ -16,3 +21,38 @@ func Itob(i int) bool {
 	}
 	return false
 }
+
+// Btoi - Proxmox expects booleans as 1/0
+func Btoi(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// toInt - numbers from the API are usually float64, but some come as strings
+func toInt(value interface{}) (int, error) {
+	switch v := value.(type) {
+	case float64:
+		return int(v), nil
+	case int:
+		return v, nil
+	case string:
+		if i, err := strconv.Atoi(v); err == nil {
+			return i, nil
+		}
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			return int(f), nil
+		}
+	}
+	return 0, fmt.Errorf("'%v' is not a number", value)
+}
+
+// Flags come either as JSON booleans or as 0/1, depending on the endpoint.
+func apiBool(value interface{}) bool {
+	if b, isBool := value.(bool); isBool {
+		return b
+	}
+	i, _ := toInt(value)
+	return Itob(i)
+}